@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// -----------------------------
+// ADMIN COMMANDS
+// -----------------------------
+// login grants cl admin rights when pass matches -adminpass (/login).
+func (s *Server) login(cl *client, pass string) string {
+	if s.cfg.AdminPass == "" {
+		return "Admin login is disabled"
+	}
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(s.cfg.AdminPass)) != 1 {
+		return "Wrong admin password"
+	}
+	s.mutex.Lock()
+	cl.isAdmin = true
+	s.mutex.Unlock()
+	return "You are now an admin"
+}
+
+// kick disconnects the user called name on behalf of admin cl (/kick). It
+// returns a reply for cl, or "" when the kick was announced to the room.
+func (s *Server) kick(cl *client, name string) string {
+	return s.removeUser(cl, name, false)
+}
+
+// ban kicks the user called name and bans their IP (/ban).
+func (s *Server) ban(cl *client, name string) string {
+	return s.removeUser(cl, name, true)
+}
+
+func (s *Server) removeUser(cl *client, name string, banIP bool) string {
+	s.mutex.Lock()
+	if !cl.isAdmin {
+		s.mutex.Unlock()
+		return "Permission denied"
+	}
+	target := s.findClient(name)
+	if target == nil {
+		s.mutex.Unlock()
+		return "No such user: " + name
+	}
+	if target == cl {
+		s.mutex.Unlock()
+		return "You can't remove yourself"
+	}
+
+	event, notice, verb := "KICK", "You have been kicked\n", "kicked"
+	if banIP {
+		event, notice, verb = "BAN", "You have been banned\n", "banned"
+		s.banned[hostOf(target.addr)] = true
+		if err := s.saveBans(); err != nil {
+			s.eventLog.Printf("Error: %v", err)
+		}
+	}
+
+	delete(s.clients, target)
+	s.admitWaiter()
+	s.recordDeparture(target.name)
+	room := target.room
+	s.leaveRoom(target)
+	target.send(notice)
+	target.close()
+	name = target.name
+	s.mutex.Unlock()
+
+	s.logEvent(event, "%s (%s) %s by %s", target.addr, name, verb, cl.name)
+	s.announcePresence(room, fmt.Sprintf("%s was %s", name, verb), nil)
+	return ""
+}
+
+// unban lifts the ban on ip (/unban).
+func (s *Server) unban(cl *client, ip string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !cl.isAdmin {
+		return "Permission denied"
+	}
+	if !s.banned[ip] {
+		return ip + " is not banned"
+	}
+	delete(s.banned, ip)
+	if err := s.saveBans(); err != nil {
+		s.eventLog.Printf("Error: %v", err)
+	}
+	s.logEvent("UNBAN", "%s unbanned by %s", ip, cl.name)
+	return ip + " is no longer banned"
+}
+
+// -----------------------------
+// BAN LIST
+// -----------------------------
+// hostOf strips the port from a remote address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// isBanned reports whether the remote address addr is banned.
+func (s *Server) isBanned(addr string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.banned[hostOf(addr)]
+}
+
+// loadBans reads BanFile if it exists.
+func (s *Server) loadBans() error {
+	data, err := os.ReadFile(s.cfg.BanFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, ip := range strings.Fields(string(data)) {
+		s.banned[ip] = true
+	}
+	return nil
+}
+
+// saveBans rewrites BanFile. Caller must hold mutex.
+func (s *Server) saveBans() error {
+	ips := make([]string, 0, len(s.banned))
+	for ip := range s.banned {
+		ips = append(ips, ip+"\n")
+	}
+	sort.Strings(ips)
+	return os.WriteFile(s.cfg.BanFile, []byte(strings.Join(ips, "")), 0o644)
+}
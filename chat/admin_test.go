@@ -0,0 +1,61 @@
+package chat
+
+import "testing"
+
+func TestAdminCommandsNeedLogin(t *testing.T) {
+	s := startServer(t, func(cfg *Config) { cfg.AdminPass = "secret" })
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+
+	for _, line := range []string{"/kick alice", "/ban alice", "/shutdown", "/drain", "/broadcast hi"} {
+		bob.send(line)
+		bob.expect("Permission denied")
+	}
+	bob.send("/login wrong")
+	bob.expect("Wrong admin password")
+	bob.send("/kick alice")
+	bob.expect("Permission denied")
+	alice.send("/list")
+	alice.expect("alice, bob")
+
+	bob.send("/login secret")
+	bob.expect("You are now an admin")
+	bob.send("/kick alice")
+	alice.expect("You have been kicked")
+	alice.expectClosed()
+	bob.expect("alice was kicked")
+}
+
+func TestRemoveUserChecksAdmin(t *testing.T) {
+	s := startServer(t, nil)
+	join(t, s, "alice")
+	join(t, s, "bob")
+
+	s.mutex.Lock()
+	bob := s.findClient("bob")
+	s.mutex.Unlock()
+	if reply := s.removeUser(bob, "alice", true); reply != "Permission denied" {
+		t.Errorf("non-admin removeUser = %q, want Permission denied", reply)
+	}
+	if s.isBanned("127.0.0.1:1") {
+		t.Error("refused ban was recorded")
+	}
+
+	s.mutex.Lock()
+	bob.isAdmin = true
+	s.mutex.Unlock()
+	if reply := s.removeUser(bob, "bob", false); reply != "You can't remove yourself" {
+		t.Errorf("self removeUser = %q", reply)
+	}
+	if reply := s.removeUser(bob, "nobody", false); reply != "No such user: nobody" {
+		t.Errorf("removeUser of unknown user = %q", reply)
+	}
+	if reply := s.removeUser(bob, "alice", false); reply != "" {
+		t.Errorf("admin removeUser = %q, want it announced", reply)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.findClient("alice") != nil {
+		t.Error("alice still connected after kick")
+	}
+}
@@ -0,0 +1,1656 @@
+// Package chat is the TCPChat server: rooms, commands, history and the
+// connection handling behind them. The TCPChat command is a thin flag
+// front end to it; other programs can run servers of their own:
+//
+//	srv := chat.NewServer(chat.DefaultConfig())
+//	if err := srv.Start(ctx); err != nil {
+//		...
+//	}
+//	srv.Wait()
+package chat
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// -----------------------------
+// CONFIGURATION
+// -----------------------------
+const defaultPort = "8989"
+
+const defaultMaxClients = 10
+
+const defaultMaxPerIP = 3
+
+// MaxHistory is how many messages each room keeps in memory. Older
+// messages are dropped.
+const MaxHistory = 100
+
+// defaultHistoryLines is how many messages /history replays when no count
+// is given.
+const defaultHistoryLines = 20
+
+const defaultHistoryFile = "chat.log"
+
+const defaultBanFile = "bans.txt"
+
+const defaultLogoPath = "linuxlogo.txt"
+
+// maxLogoSize caps the logo file, which is sent to every client.
+const maxLogoSize = 64 * 1024
+
+const defaultTimeFormat = "2006-01-02 15:04:05"
+
+const defaultNamePrompt = "[ENTER YOUR NAME]: "
+
+// maxMessageLen is the longest chat message (in characters) that is
+// broadcast. Longer lines are rejected with a notice to the sender.
+const maxMessageLen = 1024
+
+// maxNameLen is the longest allowed user name, in characters.
+const maxNameLen = 16
+
+// outboxSize is how many pending lines a client may have queued. A client
+// that falls this far behind is disconnected instead of stalling the chat.
+const outboxSize = 256
+
+// writeTimeout bounds a single write to a client's connection.
+const writeTimeout = 10 * time.Second
+
+// keepAlivePeriod is how often TCP keepalive probes check that a silent
+// peer still exists, so dead connections get reaped.
+const keepAlivePeriod = 30 * time.Second
+
+const defaultNameTimeout = 60 * time.Second
+
+// idleTimeout disconnects clients that send nothing for this long.
+const idleTimeout = 5 * time.Minute
+
+// rateLimit messages are allowed per rateWindow; extra ones are dropped.
+const (
+	rateLimit  = 5
+	rateWindow = 2 * time.Second
+)
+
+// repeatWindow is how soon an identical message counts as a repeat and
+// is dropped.
+const repeatWindow = 3 * time.Second
+
+// maxPasswordAttempts is how many wrong passwords a client may enter
+// before being disconnected.
+const maxPasswordAttempts = 3
+
+// maxNameAttempts is how many rejected names a client may enter before
+// being disconnected with errTooManyNames.
+const maxNameAttempts = 5
+
+var errTooManyNames = errors.New("too many invalid name attempts")
+
+// maxLineLen is the scanner buffer size. A line that does not fit in it at
+// all cannot be read, so the client is told and disconnected.
+const maxLineLen = 256 * 1024
+
+// -----------------------------
+// ANSI COLOR CODES
+// -----------------------------
+const (
+	ColorReset   = "\033[0m"
+	ColorRed     = "\033[31m"
+	ColorGreen   = "\033[32m"
+	ColorYellow  = "\033[33m"
+	ColorBlue    = "\033[34m"
+	ColorMagenta = "\033[35m"
+	ColorCyan    = "\033[36m"
+	ColorWhite   = "\033[37m"
+	ColorNotice  = "\033[1;33m" // bold yellow, for admin /broadcast
+
+	// ClearScreen is sent only for /clear; user input never carries escapes
+	ClearScreen = "\033[2J\033[H"
+
+	// ClearLine returns to column 0 and erases the line (-readline)
+	ClearLine = "\r\033[K"
+)
+
+// colorize wraps text in color unless colors are disabled with -nocolor.
+// All colored output goes through here.
+func (s *Server) colorize(color, text string) string {
+	if s.cfg.NoColor {
+		return text
+	}
+	return color + text + ColorReset
+}
+
+// -----------------------------
+// MESSAGES
+// -----------------------------
+// MessageKind tells how a Message is rendered.
+type MessageKind string
+
+const (
+	KindChat     MessageKind = "chat"
+	KindAnnounce MessageKind = "announce"
+	KindEmote    MessageKind = "emote"
+	KindPrivate  MessageKind = "private" // never stored in history
+	KindPaste    MessageKind = "paste"   // multi-line block from /paste
+)
+
+// Message is a chat line as stored in history. It is rendered per
+// recipient at send time, so client preferences apply to replay too.
+type Message struct {
+	Time   time.Time   `json:"time"`
+	Sender string      `json:"sender,omitempty"`
+	Text   string      `json:"text"`
+	Kind   MessageKind `json:"kind"`
+	Room   string      `json:"room,omitempty"`
+	Seq    uint64      `json:"seq,omitempty"` // assigned at broadcast, public messages only
+	To     string      `json:"to,omitempty"`  // recipient of a private message
+}
+
+// format renders m (without color) for c's preferences. Caller must hold
+// mutex.
+func (m Message) format(c *client) string {
+	s := c.srv
+	prefix := ""
+	if s.cfg.Debug && m.Seq != 0 {
+		prefix = fmt.Sprintf("#%d ", m.Seq)
+	}
+	if m.Kind == KindAnnounce {
+		return m.Text
+	}
+	text := m.Text
+	if c.emoji {
+		text = expandShortcodes(text)
+	}
+	switch m.Kind {
+	case KindEmote:
+		return fmt.Sprintf("%s* %s %s", prefix, m.Sender, text)
+	case KindPrivate:
+		if m.Sender == c.name {
+			prefix = "(to " + m.To + ") "
+		} else {
+			prefix = "(private) "
+		}
+	case KindPaste:
+		text = "(paste)\n" + text
+	}
+	if !c.showTime {
+		return fmt.Sprintf("%s[%s]:%s", prefix, m.Sender, text)
+	}
+	timestamp := s.formatTime(m.Time)
+	return fmt.Sprintf("%s[%s][%s]:%s", prefix, timestamp, m.Sender, text)
+}
+
+// render returns m as the line to send to c: a JSON object in /json mode,
+// otherwise m.format(c) in color. Caller must hold mutex.
+func (m Message) render(c *client, color string) string {
+	s := c.srv
+	if c.jsonMode.Load() {
+		line, _ := json.Marshal(m)
+		return string(line) + "\n"
+	}
+	return s.colorize(color, m.format(c)) + "\n"
+}
+
+// replay renders m as a line of history replay for c: chat in red, system
+// messages in the same yellow they were announced in. Caller must hold
+// mutex.
+func (m Message) replay(c *client) string {
+	if m.Kind == KindAnnounce {
+		return m.render(c, ColorYellow)
+	}
+	return m.render(c, ColorRed)
+}
+
+// formatTime renders t with the configured layout and time zone.
+func (s *Server) formatTime(t time.Time) string {
+	if s.cfg.UTC {
+		t = t.UTC()
+	}
+	return t.Format(s.cfg.TimeFormat)
+}
+
+// -----------------------------
+// MESSAGE RING BUFFER
+// -----------------------------
+// messageRing keeps the most recent messages up to a fixed capacity.
+type messageRing struct {
+	buf   []Message
+	start int
+	size  int
+}
+
+func newMessageRing(capacity int) *messageRing {
+	return &messageRing{buf: make([]Message, capacity)}
+}
+
+// add appends msg, overwriting the oldest entry when the ring is full.
+func (r *messageRing) add(msg Message) {
+	if r.size < len(r.buf) {
+		r.buf[(r.start+r.size)%len(r.buf)] = msg
+		r.size++
+		return
+	}
+	r.buf[r.start] = msg
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// list returns the retained messages, oldest first.
+func (r *messageRing) list() []Message {
+	out := make([]Message, r.size)
+	for i := range out {
+		out[i] = r.buf[(r.start+i)%len(r.buf)]
+	}
+	return out
+}
+
+// -----------------------------
+// CHAT HISTORY
+// -----------------------------
+// loadHistory reads previous messages from HistoryFile (if any) and keeps
+// the file open for appending. Each line is a JSON Message; lines from
+// older plain-text logs are kept verbatim.
+func (s *Server) loadHistory() error {
+	data, err := os.ReadFile(s.cfg.HistoryFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		var msg Message
+		if json.Unmarshal([]byte(line), &msg) != nil {
+			msg = Message{Text: line, Kind: KindAnnounce}
+		}
+		if msg.Room == "" {
+			msg.Room = defaultRoom
+		}
+		// Keep sequence numbers increasing across restarts
+		if msg.Seq > s.lastSeq {
+			s.lastSeq = msg.Seq
+		}
+		s.getRoom(msg.Room).messages.add(msg)
+	}
+
+	s.historyLog, err = os.OpenFile(s.cfg.HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	return err
+}
+
+// closeHistory closes HistoryFile; later messages are kept in memory only.
+func (s *Server) closeHistory() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.historyLog.Close()
+	s.historyLog = nil
+}
+
+// addMessage stores msg in room's history and in HistoryFile. Caller must
+// hold mutex.
+func (s *Server) addMessage(room *Room, msg Message) {
+	msg.Room = room.name
+	room.messages.add(msg)
+	if s.historyLog == nil {
+		return
+	}
+	line, err := json.Marshal(msg)
+	if err == nil {
+		_, err = s.historyLog.Write(append(line, '\n'))
+	}
+	if err != nil {
+		s.eventLog.Printf("Error: %v", err)
+	}
+}
+
+// -----------------------------
+// EVENT LOG
+// -----------------------------
+// openEventLog redirects connection events to LogFile when one is set.
+func (s *Server) openEventLog() error {
+	if s.cfg.LogFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(s.cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	s.eventLog.SetOutput(f)
+	return nil
+}
+
+// logEvent writes a timestamped line such as "[JOIN] 1.2.3.4:5 joined as bob".
+func (s *Server) logEvent(event, format string, args ...any) {
+	s.eventLog.Printf("["+event+"] "+format, args...)
+}
+
+// -----------------------------
+// CLIENT
+// -----------------------------
+// client owns a connection and a queue of outgoing lines. A dedicated
+// writer goroutine drains the queue, so writes from different goroutines
+// never interleave and nobody blocks on a slow connection.
+//
+// name, joinedAt, showTime, ignored, room, isAdmin, lastMessageTime, away,
+// color, muted, emoji and mentions are guarded by the server's mutex once
+// the client is in clients; out, done and closed are guarded by mu. name is only
+// changed by the client's own goroutine, which may therefore read it unlocked.
+// jsonMode is atomic because send reads it without either lock.
+type client struct {
+	srv      *Server
+	conn     net.Conn
+	addr     string
+	name     string
+	joinedAt time.Time
+	showTime bool
+	ignored  map[string]bool // lower-cased names whose messages are hidden
+	room     *Room
+	isAdmin  bool
+
+	lastMessageTime time.Time // zero until the first public message
+
+	away       bool
+	awayReason string
+
+	color    string      // color others see this client's messages in; "" is blue
+	muted    bool        // receives no room messages or announcements (/mute)
+	emoji    bool        // expand shortcodes in messages shown to this client
+	mentions bool        // ring the bell on messages containing @name
+	jsonMode atomic.Bool // messages are sent as JSON lines (/json)
+
+	// Rate limiter and repeat filter state, only touched by the client's
+	// own goroutine
+	windowStart time.Time
+	windowCount int
+	lastText    string
+	lastTextAt  time.Time
+	warnedDup   bool
+	sent        int  // public messages sent this session, for -maxmessages
+	capped      bool // sent reached -maxmessages; the session ends
+
+	// Open /paste block, only touched by the client's own goroutine. A
+	// client that disconnects mid-paste takes the buffer with it.
+	pasting  bool
+	paste    []string
+	pasteLen int
+
+	quit  bool   // set by /quit, only touched by the client's own goroutine
+	token string // reconnect token issued at join
+
+	out    chan string
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *Server) newClient(conn net.Conn) *client {
+	c := &client{
+		srv:      s,
+		conn:     conn,
+		addr:     conn.RemoteAddr().String(),
+		showTime: true,
+		emoji:    true,
+		mentions: true,
+		ignored:  make(map[string]bool),
+		out:      make(chan string, outboxSize),
+		done:     make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// send queues s for delivery without blocking. If the queue is full the
+// client is too slow to keep up and its connection is dropped.
+func (c *client) send(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if c.srv.cfg.Readline && !c.jsonMode.Load() {
+		s = ClearLine + s
+	}
+	select {
+	case c.out <- s:
+	default:
+		c.conn.Close()
+	}
+}
+
+// allowMessage reports whether the client may send another message in the
+// current rate window.
+func (c *client) allowMessage(now time.Time) bool {
+	if now.Sub(c.windowStart) >= rateWindow {
+		c.windowStart = now
+		c.windowCount = 0
+	}
+	c.windowCount++
+	return c.windowCount <= rateLimit
+}
+
+// countPublic counts a public message (chat line, paste, emote, shrug or
+// roll) toward -maxmessages. Once the limit is reached cl.capped ends the
+// session after the current line.
+func (c *client) countPublic() {
+	c.sent++
+	if limit := c.srv.cfg.MaxSessionMessages; limit > 0 && c.sent >= limit {
+		c.capped = true
+	}
+}
+
+// isRepeat reports whether text repeats the client's previous message
+// within repeatWindow. The first repeat of a run is reported to the client.
+func (c *client) isRepeat(text string, now time.Time) bool {
+	if text == c.lastText && now.Sub(c.lastTextAt) < repeatWindow {
+		c.lastTextAt = now
+		if !c.warnedDup {
+			c.warnedDup = true
+			c.send("Repeated message not sent\n")
+		}
+		return true
+	}
+	c.lastText, c.lastTextAt, c.warnedDup = text, now, false
+	return false
+}
+
+// close stops accepting new lines. The writer flushes what is already
+// queued and then closes the connection.
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.out)
+	}
+}
+
+func (c *client) writeLoop() {
+	defer close(c.done)
+	defer c.conn.Close()
+	if c.srv.cfg.WriteBatch > 0 {
+		c.batchWriteLoop()
+		return
+	}
+	w := fullWriter{c.conn}
+	for s := range c.out {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := w.Write([]byte(s)); err != nil {
+			c.writeFailed()
+			return
+		}
+	}
+}
+
+// batchWriteLoop is writeLoop for -batch: lines arriving within
+// WriteBatch of each other are buffered and sent with one write. What is
+// buffered is flushed before the loop returns on close.
+func (c *client) batchWriteLoop() {
+	batch := c.srv.cfg.WriteBatch
+	w := bufio.NewWriter(fullWriter{c.conn})
+	for s := range c.out {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout + batch))
+		w.WriteString(s)
+		timer := time.NewTimer(batch)
+	collect:
+		for {
+			select {
+			case s, ok := <-c.out:
+				if !ok {
+					break collect // closed: flush the tail, then range ends
+				}
+				w.WriteString(s)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		if err := w.Flush(); err != nil {
+			c.writeFailed()
+			return
+		}
+	}
+}
+
+// fullWriter keeps writing until all of p is written or the write fails,
+// so a short write from a conn that doesn't retry itself can't drop the
+// tail of a line. A write that makes no progress is an error.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (f fullWriter) Write(p []byte) (int, error) {
+	total := 0
+	for total < len(p) {
+		n, err := f.w.Write(p[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.ErrShortWrite
+		}
+	}
+	return total, nil
+}
+
+// writeFailed stops queueing lines nobody will write. Closing the conn
+// (deferred in writeLoop) wakes the reader, which removes the client from
+// clients and its room and announces the leave.
+func (c *client) writeFailed() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+}
+
+// -----------------------------
+// HANDLE CLIENT CONNECTION
+// -----------------------------
+// handleConnection runs one client's session. Canceling ctx closes conn,
+// which ends the session wherever it is blocked reading.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	cl := s.newClient(conn)
+	defer cl.close()
+
+	// Send logo
+	cl.send(s.logo)
+	if s.motd != "" {
+		cl.send(s.motd)
+	}
+
+	// One scanner for the whole session so bytes buffered past the name
+	// line are not lost. bufio.ScanLines drops the \r of a telnet/Windows
+	// \r\n ending, and TrimSpace/sanitize remove any stray ones.
+	var input io.Reader = conn
+	if s.cfg.Telnet {
+		input = &telnetReader{r: conn}
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLen)
+
+	// Get client name. The deadline is replaced by idleTimeout once the
+	// message loop starts.
+	conn.SetReadDeadline(time.Now().Add(s.cfg.NameTimeout))
+	name, err := s.getClientName(cl, scanner)
+	switch {
+	case err == io.EOF:
+		s.logEvent("LEAVE", "%s disconnected before joining", cl.addr)
+		return
+	case isTimeout(err):
+		cl.send("Name entry timed out\n")
+		s.logEvent("LEAVE", "%s timed out before joining", cl.addr)
+		return
+	case err == bufio.ErrTooLong:
+		cl.send("Line too long, disconnecting.\n")
+		s.logEvent("LEAVE", "%s sent an overlong name line", cl.addr)
+		return
+	case err == errTooManyNames:
+		cl.send("Too many invalid name attempts\n")
+		s.logEvent("LEAVE", "%s gave up after %d invalid names", cl.addr, maxNameAttempts)
+		return
+	case err != nil:
+		s.logEvent("LEAVE", "%s lost connection before joining: %v", cl.addr, err)
+		return
+	}
+	if s.cfg.Password != "" && !s.authenticate(cl, scanner) {
+		if isTimeout(scanner.Err()) {
+			cl.send("\nName entry timed out\n")
+		}
+		s.releaseName(name)
+		s.logEvent("LEAVE", "%s (%s) failed authentication", cl.addr, name)
+		return
+	}
+	if name == lurkName {
+		s.lurk(cl, scanner)
+		return
+	}
+
+	// Add client to the default room and replay its old messages
+	s.mutex.Lock()
+	cl.name = name
+	cl.joinedAt = time.Now()
+	s.clients[cl] = true
+	delete(s.pendingNames, nameSkeleton(name))
+	room := s.getRoom(defaultRoom)
+	room.members[cl] = true
+	cl.room = room
+	if history := s.historyLocked(cl, s.cfg.JoinReplay); history != "" {
+		cl.send(history)
+	}
+	// Counted after the insert above, so it includes the new client
+	users := "users"
+	if len(s.clients) == 1 {
+		users = "user"
+	}
+	cl.send(s.colorize(ColorYellow, fmt.Sprintf("You joined as %s. %d %s online.", name, len(s.clients), users)) + "\n")
+	cl.token = newToken()
+	cl.send(fmt.Sprintf("If your connection drops, enter %sreconnect %s at the name prompt within %s to keep your name.\n",
+		s.cfg.CommandPrefix, cl.token, formatUptime(reconnectGrace)))
+	if topic := s.topicLine(room); topic != "" {
+		cl.send(topic)
+	}
+	rejoin := s.rejoinedRecently(name)
+	s.mutex.Unlock()
+
+	// Announce join (yellow) to others only, unless it looks like a flaky
+	// connection coming back
+	if rejoin {
+		s.logEvent("JOIN", "%s joined as %s (rejoin, not announced)", cl.addr, name)
+	} else {
+		s.logEvent("JOIN", "%s joined as %s", cl.addr, name)
+		s.announcePresence(room, fmt.Sprintf("%s has joined our chat...", name), cl)
+	}
+
+	// Listen for messages, refreshing the idle deadline on every line
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		// Lines that aren't valid UTF-8 are dropped rather than repaired, so
+		// binary garbage never reaches other terminals
+		if !utf8.ValidString(scanner.Text()) {
+			cl.send("Message dropped: not valid UTF-8 text\n")
+			continue
+		}
+		var msg Message
+		if cl.pasting {
+			block, done := cl.pasteLine(sanitize(scanner.Text()))
+			if !done || block == "" {
+				continue
+			}
+			if !cl.allowMessage(time.Now()) {
+				cl.send("You're sending too fast\n")
+				continue
+			}
+			msg = Message{Time: time.Now(), Sender: cl.name, Text: block, Kind: KindPaste}
+		} else {
+			text := strings.TrimSpace(sanitize(scanner.Text()))
+			if text == "" {
+				continue
+			}
+			text, handled := s.dispatchCommand(cl, text)
+			if cl.quit || cl.capped {
+				break
+			}
+			if handled || cl.isRepeat(text, time.Now()) || !allowPublic(cl, text) {
+				continue
+			}
+			msg = Message{Time: time.Now(), Sender: cl.name, Text: text, Kind: KindChat}
+		}
+		s.broadcast(msg, cl)
+		if cl.countPublic(); cl.capped {
+			break
+		}
+	}
+	// /nick may have changed the name
+	name = cl.name
+	leaveMsg := fmt.Sprintf("%s has left our chat...", name)
+	// Only a connection that failed keeps its name for /reconnect; a clean
+	// hangup (Ctrl-C in nc) frees it like /quit
+	lost := false
+	switch err := scanner.Err(); {
+	case cl.capped:
+		cl.send("Session message limit reached\n")
+		leaveMsg = fmt.Sprintf("%s reached the session message limit...", name)
+	case err == bufio.ErrTooLong:
+		cl.send("Line too long, disconnecting.\n")
+	case isTimeout(err):
+		cl.send("Disconnected due to inactivity\n")
+		leaveMsg = fmt.Sprintf("%s was disconnected due to inactivity...", name)
+		lost = true
+	case err != nil:
+		// Reset, keepalive failure or a connection we closed ourselves
+		leaveMsg = fmt.Sprintf("%s lost connection...", name)
+		lost = true
+	}
+
+	// Client disconnect. A kicked client was already removed and announced.
+	s.mutex.Lock()
+	joined := s.clients[cl]
+	if joined {
+		delete(s.clients, cl)
+		s.admitWaiter()
+		s.recordDeparture(name)
+		s.noteLeave(name)
+		room = cl.room
+		s.leaveRoom(cl)
+		if lost {
+			s.holdName(cl)
+		}
+	}
+	s.mutex.Unlock()
+	if joined {
+		s.logEvent("LEAVE", "%s (%s) left", cl.addr, name)
+		s.announcePresence(room, leaveMsg, nil)
+	}
+}
+
+// isTimeout reports whether err is a read deadline expiring.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// allowPublic checks the length limit and rate limit for text that is
+// about to be shown to the room, telling cl when it is refused.
+func allowPublic(cl *client, text string) bool {
+	if utf8.RuneCountInString(text) > maxMessageLen {
+		cl.send(fmt.Sprintf("Message too long (max %d chars)\n", maxMessageLen))
+		return false
+	}
+	if !cl.allowMessage(time.Now()) {
+		cl.send("You're sending too fast\n")
+		return false
+	}
+	return true
+}
+
+// enableKeepAlive turns on TCP keepalive for conn (or the TCP connection
+// under a TLS one).
+func enableKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(keepAlivePeriod)
+	}
+}
+
+// releaseIP gives back the per-IP connection slot taken in admit.
+func (s *Server) releaseIP(ip string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+// -----------------------------
+// LOAD LOGO
+// -----------------------------
+// defaultLogo is sent when the logo file is missing or unusable. The name
+// prompt follows it on the next line.
+const defaultLogo = "Welcome to TCP-Chat!"
+
+// loadLogo reads the logo at path, falling back to defaultLogo when it
+// can't be read, is larger than maxLogoSize or isn't printable text.
+func (s *Server) loadLogo(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		s.eventLog.Printf("Warning: cannot read logo: %v", err)
+		return defaultLogo
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxLogoSize+1))
+	switch {
+	case err != nil:
+		s.eventLog.Printf("Warning: cannot read logo: %v", err)
+		return defaultLogo
+	case len(data) > maxLogoSize:
+		s.eventLog.Printf("Warning: logo %s is larger than %d bytes, using the default", path, maxLogoSize)
+		return defaultLogo
+	case !printableText(string(data)):
+		s.eventLog.Printf("Warning: logo %s is not printable text, using the default", path)
+		return defaultLogo
+	}
+	return string(data) + "\n"
+}
+
+// printableText reports whether s is UTF-8 text without control
+// characters other than newlines, tabs and the ESC of ANSI art.
+func printableText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' && r != '\033' {
+			return false
+		}
+	}
+	return true
+}
+
+// -----------------------------
+// LOAD MOTD
+// -----------------------------
+// loadMOTD reads the message of the day at path. An empty path or an
+// unreadable file disables it.
+func (s *Server) loadMOTD(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		s.eventLog.Printf("Warning: cannot read MOTD: %v", err)
+		return ""
+	}
+
+	text := strings.TrimRight(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if !s.cfg.MOTDANSI {
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			lines[i] = sanitize(line)
+		}
+		text = strings.Join(lines, "\n")
+	}
+	return text + "\n"
+}
+
+// -----------------------------
+// GET CLIENT NAME (unique)
+// -----------------------------
+// getClientName prompts until cl enters a usable name, giving up with
+// errTooManyNames after maxNameAttempts rejections. Otherwise the error is
+// io.EOF when the client hung up cleanly, or the scanner's error.
+func (s *Server) getClientName(cl *client, scanner *bufio.Scanner) (string, error) {
+	cl.send("\n" + s.cfg.NamePrompt)
+	for attempts := 1; ; attempts++ {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		}
+		name := strings.TrimSpace(scanner.Text())
+		if name == lurkName {
+			return name, nil
+		}
+		var problem string
+		if token, ok := strings.CutPrefix(name, s.cfg.CommandPrefix+"reconnect "); ok {
+			if name = s.redeemToken(cl, strings.TrimSpace(token)); name != "" {
+				return name, nil
+			}
+			problem = "Unknown or expired reconnect token"
+		} else if strings.HasPrefix(name, s.cfg.CommandPrefix) {
+			problem = s.prefixRule()
+		} else if !validName(name) {
+			problem = nameRule
+		} else if reservedName(name) {
+			problem = "That name is reserved. Choose another name:"
+		} else if !s.reserveName(cl, name) {
+			problem = "Name already taken. Choose another name:"
+		} else {
+			return name, nil
+		}
+
+		// A script stuck on a taken name would otherwise hold its
+		// connection here until NameTimeout
+		if attempts == maxNameAttempts {
+			cl.send(problem + "\n")
+			return "", errTooManyNames
+		}
+		cl.send(problem + "\n" + s.cfg.NamePrompt)
+	}
+}
+
+// -----------------------------
+// SANITIZE USER INPUT
+// -----------------------------
+// sanitize drops ESC and every other control character so user input can't
+// carry terminal escape sequences. Tabs become spaces.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// -----------------------------
+// PASSWORD GATE
+// -----------------------------
+// authenticate asks for the server password, allowing maxPasswordAttempts
+// tries. The password is never echoed or logged.
+func (s *Server) authenticate(cl *client, scanner *bufio.Scanner) bool {
+	for i := 0; i < maxPasswordAttempts; i++ {
+		if s.cfg.Telnet {
+			cl.send(telnetEchoOff)
+		}
+		cl.send("[PASSWORD]: ")
+		if !scanner.Scan() {
+			return false
+		}
+		if s.cfg.Telnet {
+			// The client didn't echo the Enter key either
+			cl.send(telnetEchoOn + "\n")
+		}
+		given := strings.TrimSpace(scanner.Text())
+		if subtle.ConstantTimeCompare([]byte(given), []byte(s.cfg.Password)) == 1 {
+			return true
+		}
+		cl.send("Wrong password.\n")
+	}
+	cl.send("Too many failed attempts\n")
+	return false
+}
+
+// -----------------------------
+// NAME VALIDATION
+// -----------------------------
+var nameRule = fmt.Sprintf("Name must be 1-%d printable characters, no spaces, combining marks or mixed alphabets", maxNameLen)
+
+// nameScripts are the alphabets a name may be written in; a name may use
+// only one of them (plus digits and punctuation).
+var nameScripts = []*unicode.RangeTable{
+	unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Arabic,
+	unicode.Hebrew, unicode.Han, unicode.Hiragana, unicode.Katakana,
+	unicode.Hangul, unicode.Thai, unicode.Devanagari, unicode.Armenian,
+	unicode.Georgian,
+}
+
+// validName reports whether name is non-empty, at most maxNameLen
+// characters and made only of valid UTF-8, printable, non-space characters (which also
+// rules out the ESC used by color codes).
+//
+// Combining marks are refused so one name can't be spelled as two
+// different code point sequences (there is no NFC in the standard
+// library), and letters from different scripts can't be mixed, which
+// stops "аlice" with a Cyrillic а.
+func validName(name string) bool {
+	if name == "" || !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxNameLen {
+		return false
+	}
+	var script *unicode.RangeTable
+	for _, r := range name {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) || unicode.In(r, unicode.Mn, unicode.Me) {
+			return false
+		}
+		for _, t := range nameScripts {
+			if unicode.Is(t, r) {
+				if script != nil && script != t {
+					return false
+				}
+				script = t
+			}
+		}
+	}
+	return true
+}
+
+// confusables maps Cyrillic and Greek letters to the Latin letters they
+// look like. Used by nameSkeleton.
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'i',
+	'ј': 'j', 'ԁ': 'd', 'ո': 'n', 'ԛ': 'q', 'ԝ': 'w',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y', 'ζ': 'z', 'η': 'n',
+}
+
+// nameSkeleton folds name to lower case and replaces lookalike letters, so
+// an all-Cyrillic "асе" collides with the Latin "ace".
+func nameSkeleton(name string) string {
+	return strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if l, ok := confusables[r]; ok {
+			return l
+		}
+		return r
+	}, name)
+}
+
+// reservedNames can't be claimed by users, so nobody can pose as the
+// server, and lurkName can't become a real name. Keys are lower case;
+// matching is case-insensitive.
+var reservedNames = map[string]bool{
+	"server": true,
+	"system": true,
+	"admin":  true,
+	lurkName: true,
+}
+
+func reservedName(name string) bool {
+	return reservedNames[nameSkeleton(name)]
+}
+
+// prefixRule explains why a name may not start with the command prefix:
+// every line that does is read as a command.
+func (s *Server) prefixRule() string {
+	return fmt.Sprintf("Name can't start with %q, which begins a command", s.cfg.CommandPrefix)
+}
+
+// -----------------------------
+// NAME UNIQUENESS (caller must hold mutex)
+// -----------------------------
+// nameTaken reports whether another client already uses name. Names are
+// compared case-insensitively and by nameSkeleton, so lookalikes count as
+// taken; except is skipped so a client can change the case of its own name.
+// Names held for a reconnect token or reserved by a client still joining
+// are taken too.
+func (s *Server) nameTaken(name string, except *client) bool {
+	skeleton := nameSkeleton(name)
+	for c := range s.clients {
+		if c != except && nameSkeleton(c.name) == skeleton {
+			return true
+		}
+	}
+	if c, ok := s.pendingNames[skeleton]; ok && c != except {
+		return true
+	}
+	return s.nameHeld(skeleton)
+}
+
+// reserveName claims name for cl unless it is taken, checking and claiming
+// in one critical section so two clients can't both get it. The claim
+// ends when cl joins or with releaseName.
+func (s *Server) reserveName(cl *client, name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nameTaken(name, nil) {
+		return false
+	}
+	s.pendingNames[nameSkeleton(name)] = cl
+	return true
+}
+
+// releaseName drops the claim on a name whose client never joined.
+func (s *Server) releaseName(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pendingNames, nameSkeleton(name))
+}
+
+// findClient returns the connected client called name (case-insensitive),
+// or nil. Caller must hold mutex.
+func (s *Server) findClient(name string) *client {
+	for c := range s.clients {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// -----------------------------
+// RENAME CLIENT (/nick)
+// -----------------------------
+func (s *Server) renameClient(cl *client, newName string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nameTaken(newName, cl) {
+		return "", false
+	}
+	oldName := cl.name
+	cl.name = newName
+	return oldName, true
+}
+
+// -----------------------------
+// REPLAY HISTORY (/history)
+// -----------------------------
+// recentHistory renders the last n messages of cl's room in the same
+// style as the replay at join, or "" if there are none. n is capped at
+// what the room retains.
+func (s *Server) recentHistory(cl *client, n int) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.historyLocked(cl, n)
+}
+
+// historyLocked is recentHistory for callers that hold mutex.
+func (s *Server) historyLocked(cl *client, n int) string {
+	msgs := cl.room.messages.list()
+	if n < len(msgs) {
+		msgs = msgs[len(msgs)-n:]
+	}
+	var b strings.Builder
+	for _, msg := range msgs {
+		b.WriteString(msg.replay(cl))
+	}
+	return b.String()
+}
+
+// -----------------------------
+// LIST ONLINE CLIENTS (/list)
+// -----------------------------
+// listClients lists the members of cl's current room.
+func (s *Server) listClients(cl *client) string {
+	s.mutex.Lock()
+	room := cl.room
+	names := make([]string, 0, len(room.members))
+	for c := range room.members {
+		if s.lurkers[c] {
+			continue
+		}
+		if c.away {
+			names = append(names, c.name+" (away)")
+		} else {
+			names = append(names, c.name)
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Strings(names)
+	return fmt.Sprintf("Online in #%s (%d): %s", room.name, len(names), strings.Join(names, ", "))
+}
+
+// -----------------------------
+// CLIENT DETAILS (/whois)
+// -----------------------------
+// whois tells cl when the user called name connected. Like /info, only
+// admins see the address.
+func (s *Server) whois(cl *client, name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.findClient(name)
+	if c == nil {
+		return "No such user: " + name
+	}
+	from := ""
+	if cl.isAdmin {
+		from = " from " + c.addr
+	}
+	return fmt.Sprintf("%s: connected%s since %s (%s)",
+		c.name, from, s.formatTime(c.joinedAt),
+		time.Since(c.joinedAt).Round(time.Second))
+}
+
+// -----------------------------
+// USER INFO (/info)
+// -----------------------------
+// info describes the user called name for cl. Their address is only shown
+// to admins.
+func (s *Server) info(cl *client, name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.findClient(name)
+	if c == nil {
+		return "No such user: " + name + "\n"
+	}
+	admin := "no"
+	if c.isAdmin {
+		admin = "yes"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", c.name)
+	fmt.Fprintf(&b, "  Joined:  %s (%s ago)\n", s.formatTime(c.joinedAt), formatUptime(time.Since(c.joinedAt)))
+	fmt.Fprintf(&b, "  Room:    #%s\n", c.room.name)
+	fmt.Fprintf(&b, "  Status:  %s\n", presence(c))
+	fmt.Fprintf(&b, "  Admin:   %s\n", admin)
+	if cl.isAdmin {
+		fmt.Fprintf(&b, "  Address: %s\n", c.addr)
+	}
+	return b.String()
+}
+
+// whoami describes cl to itself for /whoami.
+func (s *Server) whoami(cl *client) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("You are %s in #%s, %s\n", cl.name, cl.room.name, presence(cl))
+}
+
+// presence is "here", "away" or "away: reason". Caller must hold mutex.
+func presence(c *client) string {
+	if !c.away {
+		return "here"
+	}
+	if c.awayReason == "" {
+		return "away"
+	}
+	return "away: " + c.awayReason
+}
+
+// -----------------------------
+// REJOIN DEBOUNCE (-rejoinquiet)
+// -----------------------------
+// defaultRejoinQuiet is long enough to cover a client reconnecting straight
+// after a drop.
+const defaultRejoinQuiet = 5 * time.Second
+
+// noteLeave records that name left, and forgets leaves older than
+// RejoinQuiet. Caller must hold mutex.
+func (s *Server) noteLeave(name string) {
+	if s.cfg.RejoinQuiet == 0 {
+		return
+	}
+	now := time.Now()
+	for k, at := range s.recentLeaves {
+		if now.Sub(at) >= s.cfg.RejoinQuiet {
+			delete(s.recentLeaves, k)
+		}
+	}
+	s.recentLeaves[nameSkeleton(name)] = now
+}
+
+// rejoinedRecently reports whether name left within RejoinQuiet. Only the
+// name counts: someone else joining from the same address, say behind the
+// same NAT, is a new user and gets announced.
+// Caller must hold mutex.
+func (s *Server) rejoinedRecently(name string) bool {
+	at, ok := s.recentLeaves[nameSkeleton(name)]
+	return ok && time.Since(at) < s.cfg.RejoinQuiet
+}
+
+// -----------------------------
+// RECENT DEPARTURES (/recent)
+// -----------------------------
+// maxDepartures is how many departures /recent remembers.
+const maxDepartures = 10
+
+type departure struct {
+	name string
+	at   time.Time
+}
+
+// recordDeparture notes that name just left. Caller must hold mutex.
+func (s *Server) recordDeparture(name string) {
+	if len(s.departures) == maxDepartures {
+		s.departures = s.departures[1:]
+	}
+	s.departures = append(s.departures, departure{name: name, at: time.Now()})
+}
+
+// recent lists the latest departures, newest first.
+func (s *Server) recent() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.departures) == 0 {
+		return "Nobody has left yet\n"
+	}
+	var b strings.Builder
+	b.WriteString("Recently left:\n")
+	for i := len(s.departures) - 1; i >= 0; i-- {
+		d := s.departures[i]
+		fmt.Fprintf(&b, "  %s at %s (%s ago)\n", d.name, s.formatTime(d.at), formatUptime(time.Since(d.at)))
+	}
+	return b.String()
+}
+
+// -----------------------------
+// LAST MESSAGE (/seen)
+// -----------------------------
+func (s *Server) seen(name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.findClient(name)
+	if c == nil {
+		return "No such user: " + name
+	}
+	if c.lastMessageTime.IsZero() {
+		return c.name + " hasn't sent a message yet"
+	}
+	return fmt.Sprintf("%s last sent a message at %s (%s ago)",
+		c.name, s.formatTime(c.lastMessageTime),
+		time.Since(c.lastMessageTime).Round(time.Second))
+}
+
+// -----------------------------
+// SERVER STATS (/stats)
+// -----------------------------
+func (s *Server) stats() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("Clients: %d/%d | Messages: %d | Last seq: %d | Uptime: %s",
+		len(s.clients), s.cfg.MaxClients, s.totalMessages, s.lastSeq, formatUptime(time.Since(s.startTime)))
+}
+
+// formatUptime renders d in friendly units, e.g. "45s", "12m", "2h 13m" or
+// "3d 4h 12m".
+func formatUptime(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	h := int(d.Hours()) % 24
+	m := int(d.Minutes()) % 60
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, h, m)
+	case h > 0:
+		return fmt.Sprintf("%dh %dm", h, m)
+	default:
+		return fmt.Sprintf("%dm", m)
+	}
+}
+
+// -----------------------------
+// IGNORE LIST (/ignore, /unignore)
+// -----------------------------
+// ignores reports whether c hides messages from name. Caller must hold
+// mutex.
+func (c *client) ignores(name string) bool {
+	return c.ignored[strings.ToLower(name)]
+}
+
+func (s *Server) ignoreUser(cl *client, name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	target := s.findClient(name)
+	switch {
+	case target == nil:
+		return "No such user: " + name
+	case target == cl:
+		return "You can't ignore yourself"
+	}
+	cl.ignored[strings.ToLower(target.name)] = true
+	return "Ignoring " + target.name
+}
+
+func (s *Server) unignoreUser(cl *client, name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := strings.ToLower(name)
+	if !cl.ignored[key] {
+		return "You are not ignoring " + name
+	}
+	delete(cl.ignored, key)
+	return "No longer ignoring " + name
+}
+
+func (s *Server) listIgnored(cl *client) string {
+	s.mutex.Lock()
+	names := make([]string, 0, len(cl.ignored))
+	for n := range cl.ignored {
+		names = append(names, n)
+	}
+	s.mutex.Unlock()
+
+	if len(names) == 0 {
+		return "You are not ignoring anyone"
+	}
+	sort.Strings(names)
+	return "Ignoring: " + strings.Join(names, ", ")
+}
+
+// -----------------------------
+// MESSAGE COLOR (/color)
+// -----------------------------
+// colorPalette is what /color offers. Red and yellow are left out so
+// nobody can pass for history replay or a system message.
+var colorPalette = map[string]string{
+	"blue":    ColorBlue,
+	"cyan":    ColorCyan,
+	"green":   ColorGreen,
+	"magenta": ColorMagenta,
+	"white":   ColorWhite,
+}
+
+// setColor sets the color others see cl's messages in. "default" goes back
+// to blue; no name lists the palette.
+func (s *Server) setColor(cl *client, name string) string {
+	names := make([]string, 0, len(colorPalette))
+	for n := range colorPalette {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	choices := "Colors: " + strings.Join(names, ", ") + ", default"
+
+	name = strings.ToLower(name)
+	code, ok := colorPalette[name]
+	if !ok && name != "default" {
+		if name == "" {
+			return choices
+		}
+		return "Unknown color " + name + ". " + choices
+	}
+
+	s.mutex.Lock()
+	cl.color = code
+	s.mutex.Unlock()
+	if name == "default" {
+		return "Your messages are shown in the default color"
+	}
+	return "Your messages are now shown in " + s.colorize(code, name)
+}
+
+// -----------------------------
+// AWAY STATUS (/away, /back)
+// -----------------------------
+func (s *Server) setAway(cl *client, reason string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cl.away = true
+	cl.awayReason = reason
+	return "You are now away"
+}
+
+func (s *Server) clearAway(cl *client) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !cl.away {
+		return "You are not away"
+	}
+	cl.away = false
+	cl.awayReason = ""
+	return "Welcome back"
+}
+
+// returnFromAway clears cl's away status when they talk in public again.
+// Caller must hold mutex.
+func returnFromAway(cl *client) {
+	if cl.away {
+		cl.away = false
+		cl.awayReason = ""
+		cl.send("You are no longer away\n")
+	}
+}
+
+// awayNotice is the auto-reply for a private message to c. Caller must
+// hold mutex.
+func awayNotice(c *client) string {
+	if c.awayReason == "" {
+		return c.name + " is away"
+	}
+	return c.name + " is away: " + c.awayReason
+}
+
+// -----------------------------
+// DICE (/roll)
+// -----------------------------
+// Limits for /roll so a single line can't produce a huge message.
+const (
+	maxDice     = 20
+	maxDieSides = 100
+)
+
+// roll parses a dice spec such as "2d6" or "d20" ("" means 1d6) and
+// returns the rendered result, e.g. "2d6: 4, 2 (total 6)". math/rand is
+// seeded randomly at startup by the runtime.
+func roll(spec string) (string, bool) {
+	if spec == "" {
+		spec = "1d6"
+	}
+	count, sides, ok := strings.Cut(strings.ToLower(spec), "d")
+	if !ok {
+		return "", false
+	}
+	if count == "" {
+		count = "1"
+	}
+	n, err1 := strconv.Atoi(count)
+	m, err2 := strconv.Atoi(sides)
+	if err1 != nil || err2 != nil || n < 1 || n > maxDice || m < 2 || m > maxDieSides {
+		return "", false
+	}
+
+	results := make([]string, n)
+	total := 0
+	for i := range results {
+		v := rand.Intn(m) + 1
+		total += v
+		results[i] = strconv.Itoa(v)
+	}
+	return fmt.Sprintf("%dd%d: %s (total %d)", n, m, strings.Join(results, ", "), total), true
+}
+
+// -----------------------------
+// PRIVATE MESSAGE (/msg)
+// -----------------------------
+func (s *Server) sendPrivate(sender *client, from, to, text string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c := s.findClient(to); c != nil {
+		// Private messages are never stored in the shared history
+		msg := Message{Time: time.Now(), Sender: from, Text: text, Kind: KindPrivate, To: c.name}
+		// The sender gets the usual echo either way, so ignoring someone
+		// isn't revealed to them
+		if !c.ignores(from) {
+			c.send(msg.render(c, ColorBlue))
+		}
+		sender.send(msg.render(sender, ColorGreen))
+		if c.away {
+			sender.send(awayNotice(c) + "\n")
+		}
+		return true
+	}
+	return false
+}
+
+// -----------------------------
+// BROADCAST
+// -----------------------------
+// broadcast stores msg and renders it per recipient, honoring each
+// client's preferences.
+func (s *Server) broadcast(msg Message, sender *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.clients[sender] {
+		return // kicked while the line was in flight
+	}
+	s.totalMessages++
+	s.lastSeq++
+	msg.Seq = s.lastSeq
+	sender.lastMessageTime = msg.Time
+	msg.Room = sender.room.name
+	s.addMessage(sender.room, msg)
+	returnFromAway(sender)
+	for c := range sender.room.members {
+		if c.ignores(msg.Sender) || (c.muted && c != sender) {
+			continue
+		}
+		switch {
+		case c == sender:
+			// Current user sees full message with timestamp and username in green
+			c.send(msg.render(c, ColorGreen))
+		case c.mentions && mentioned(msg.Text, c.name):
+			c.send(mentionAlert(c) + msg.render(c, ColorNotice))
+		case sender.color != "":
+			c.send(msg.render(c, sender.color))
+		default:
+			// Others see full message in blue
+			c.send(msg.render(c, ColorBlue))
+		}
+	}
+}
+
+// mentioned reports whether text addresses name as @name (any case, with
+// trailing punctuation allowed).
+func mentioned(text, name string) bool {
+	for _, word := range strings.Fields(text) {
+		word = strings.TrimRight(word, ",.:;!?)")
+		if strings.EqualFold(word, "@"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionAlert is the terminal bell sent ahead of a message mentioning c;
+// JSON clients get none.
+func mentionAlert(c *client) string {
+	if c.jsonMode.Load() {
+		return ""
+	}
+	return "\a"
+}
+
+// -----------------------------
+// ANNOUNCE SYSTEM
+// -----------------------------
+func (s *Server) announce(room *Room, msg string, excludeConn *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.announceLocked(room, msg, excludeConn)
+}
+
+// announcePresence announces a join or leave with the number of users
+// online, counted under the same lock so it reflects the change that was
+// just made to clients.
+func (s *Server) announcePresence(room *Room, msg string, excludeConn *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.announceLocked(room, fmt.Sprintf("%s (%d online)", msg, len(s.clients)), excludeConn)
+}
+
+// announceLocked is announce for callers that hold mutex.
+func (s *Server) announceLocked(room *Room, msg string, excludeConn *client) {
+	m := Message{Time: time.Now(), Text: msg, Kind: KindAnnounce, Room: room.name}
+	s.addMessage(room, m)
+	for c := range room.members {
+		if c != excludeConn && !c.muted {
+			c.send(m.render(c, ColorYellow))
+		}
+	}
+}
+
+// -----------------------------
+// SERVER NOTICE (/broadcast)
+// -----------------------------
+// serverNotice sends text to everyone in every room, muted clients
+// included, and stores it in each room's history as a system message.
+func (s *Server) serverNotice(text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, room := range s.rooms {
+		m := Message{Time: time.Now(), Text: "*** SERVER: " + text + " ***", Kind: KindAnnounce, Room: room.name}
+		s.addMessage(room, m)
+		for c := range room.members {
+			c.send(m.render(c, ColorNotice))
+		}
+	}
+}
+
+// -----------------------------
+// EMOTE (/me)
+// -----------------------------
+func (s *Server) emote(sender *client, action string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.clients[sender] {
+		return
+	}
+	msg := Message{Time: time.Now(), Sender: sender.name, Text: action, Kind: KindEmote}
+	s.totalMessages++
+	s.lastSeq++
+	msg.Seq = s.lastSeq
+	sender.lastMessageTime = msg.Time
+	msg.Room = sender.room.name
+	s.addMessage(sender.room, msg)
+	returnFromAway(sender)
+	for c := range sender.room.members {
+		if c.ignores(msg.Sender) || (c.muted && c != sender) {
+			continue
+		}
+		if c != sender && c.mentions && mentioned(msg.Text, c.name) {
+			c.send(mentionAlert(c) + msg.render(c, ColorNotice))
+			continue
+		}
+		c.send(msg.render(c, ColorMagenta))
+	}
+}
@@ -0,0 +1,890 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait for server output.
+const testTimeout = 3 * time.Second
+
+// startServer starts a server on a free loopback port, with its history,
+// bans and event log in a temporary directory, and stops it when the test
+// ends. edit, if not nil, adjusts the configuration first.
+func startServer(t testing.TB, edit func(*Config)) *Server {
+	t.Helper()
+	return startServerContext(t, context.Background(), edit)
+}
+
+// startServerContext is startServer with the context passed to Start.
+func startServerContext(t testing.TB, ctx context.Context, edit func(*Config)) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	logo := filepath.Join(dir, "logo.txt")
+	if err := os.WriteFile(logo, []byte("Welcome"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Host, cfg.Port = "127.0.0.1", "0"
+	cfg.LogoPath = logo
+	cfg.HistoryFile = filepath.Join(dir, "chat.log")
+	cfg.BanFile = filepath.Join(dir, "bans.txt")
+	cfg.LogFile = filepath.Join(dir, "events.log")
+	if edit != nil {
+		edit(&cfg)
+	}
+	s := NewServer(cfg)
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// testClient is one connection to a test server. Output is collected in
+// buf until an expect call consumes it.
+type testClient struct {
+	t    testing.TB
+	conn net.Conn
+	buf  string
+}
+
+func dial(t testing.TB, s *Server) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+// join connects and enters name, returning once the server confirms it.
+func join(t testing.TB, s *Server, name string) *testClient {
+	t.Helper()
+	c := dial(t, s)
+	c.send(name)
+	c.expect("You joined as " + name)
+	return c
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read adds whatever arrives before deadline to buf. It reports false
+// once the server has closed the connection.
+func (c *testClient) read(deadline time.Time) bool {
+	c.conn.SetReadDeadline(deadline)
+	p := make([]byte, 4096)
+	n, err := c.conn.Read(p)
+	c.buf += string(p[:n])
+	return !errors.Is(err, io.EOF)
+}
+
+// expect waits for want and drops the output up to and including it,
+// returning what came before it.
+func (c *testClient) expect(want string) string {
+	c.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !strings.Contains(c.buf, want) {
+		if !c.read(deadline) || time.Now().After(deadline) {
+			c.t.Fatalf("no %q in output %q", want, c.buf)
+		}
+	}
+	i := strings.Index(c.buf, want)
+	before := c.buf[:i]
+	c.buf = c.buf[i+len(want):]
+	return before
+}
+
+// quiet returns everything sent within d, for checking what didn't arrive.
+func (c *testClient) quiet(d time.Duration) string {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) && c.read(deadline) {
+	}
+	out := c.buf
+	c.buf = ""
+	return out
+}
+
+// drop resets the connection instead of closing it cleanly, so the server
+// sees a lost connection rather than a hangup.
+func (c *testClient) drop() {
+	c.t.Helper()
+	if err := c.conn.(*net.TCPConn).SetLinger(0); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.Close()
+}
+
+// expectClosed waits for the server to close the connection.
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for c.read(deadline) {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("connection still open, output %q", c.buf)
+		}
+	}
+}
+
+var tokenRule = regexp.MustCompile(`reconnect ([0-9a-f]+)`)
+
+func TestRejoinAnnouncements(t *testing.T) {
+	s := startServer(t, func(cfg *Config) { cfg.RejoinQuiet = 2 * time.Second })
+	alice := join(t, s, "alice")
+	bob := dial(t, s)
+	bob.send("bob")
+	bob.expect("You joined as bob")
+	bob.read(time.Now().Add(200 * time.Millisecond))
+	m := tokenRule.FindStringSubmatch(bob.buf)
+	if m == nil {
+		t.Fatalf("no reconnect token in %q", bob.buf)
+	}
+	alice.expect("bob has joined")
+
+	bob.drop()
+	alice.expect("bob lost connection")
+
+	// A flaky client coming back is not announced...
+	bob = dial(t, s)
+	bob.send("/reconnect " + m[1])
+	bob.expect("You joined as bob")
+	if out := alice.quiet(300 * time.Millisecond); strings.Contains(out, "bob has joined") {
+		t.Errorf("rejoin announced: %q", out)
+	}
+
+	// ...nor one that hung up cleanly and comes back by name...
+	bob.conn.Close()
+	alice.expect("bob has left")
+	join(t, s, "bob")
+	if out := alice.quiet(300 * time.Millisecond); strings.Contains(out, "bob has joined") {
+		t.Errorf("rejoin by name announced: %q", out)
+	}
+
+	// ...but someone new from the same address is
+	join(t, s, "carol")
+	alice.expect("carol has joined")
+}
+
+func TestNameHeldOnlyAfterLostConnection(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	token := func(c *testClient) string {
+		c.expect("reconnect ")
+		c.read(time.Now().Add(200 * time.Millisecond))
+		return strings.Fields(c.buf)[0]
+	}
+
+	// A clean hangup frees the name and its token
+	bob := join(t, s, "bob")
+	tok := token(bob)
+	bob.conn.Close()
+	alice.expect("bob has left")
+	join(t, s, "bob").conn.Close()
+	alice.expect("bob has left")
+	c := dial(t, s)
+	c.send("/reconnect " + tok)
+	c.expect("Unknown or expired reconnect token")
+
+	// A reset keeps it for the token only
+	bob = join(t, s, "bob")
+	tok = token(bob)
+	bob.drop()
+	alice.expect("bob lost connection")
+	c.send("bob")
+	c.expect("Name already taken")
+	c.send("/reconnect " + tok)
+	c.expect("You joined as bob")
+}
+
+func TestRepeatedLinesDropped(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+
+	for _, tc := range []struct{ line, shown string }{
+		{"hello", "[bob]:hello"},
+		{"/me waves", "bob waves"},
+		{"/shrug ok", "ok ¯\\_(ツ)_/¯"},
+	} {
+		bob.send(tc.line)
+		bob.send(tc.line)
+		bob.expect("Repeated message not sent")
+		out := alice.quiet(300 * time.Millisecond)
+		if n := strings.Count(out, tc.shown); n != 1 {
+			t.Errorf("%q: alice saw %q %d times in %q, want once", tc.line, tc.shown, n, out)
+		}
+	}
+}
+
+func TestSessionMessageLimit(t *testing.T) {
+	s := startServer(t, func(cfg *Config) { cfg.MaxSessionMessages = 3 })
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+
+	// Commands that reach nobody else don't count
+	bob.send("/help")
+	bob.send("/time")
+	bob.send("hello")
+	bob.send("/me waves")
+	if out := bob.quiet(300 * time.Millisecond); strings.Contains(out, "limit") {
+		t.Fatalf("limit hit after two public messages: %q", out)
+	}
+	bob.send("/roll")
+	bob.expect("Session message limit reached")
+	bob.expectClosed()
+	alice.expect("bob rolled")
+	alice.expect("bob reached the session message limit")
+}
+
+func TestSanitize(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"hello", "hello"},
+		{"bob\033[2J", "bob[2J"},
+		{"\033[31mred\033[0m", "[31mred[0m"},
+		{"a\tb", "a b"},
+		{"bell\a and\bback", "bell andback"},
+		{"line\r\n", "line"},
+		{"nul\x00byte", "nulbyte"},
+		{"c1\u009bcontrol", "c1control"},
+		{"héllo ¯\\_(ツ)_/¯", "héllo ¯\\_(ツ)_/¯"},
+	} {
+		if got := sanitize(tc.in); got != tc.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"bob", true},
+		{"Bob_42", true},
+		{"bob\033[2J", false},
+		{"\033[31malice", false},
+		{"bob\r", false},
+		{"bob\x00", false},
+		{"bob\xff", false},
+		{"", false},
+		{" ", false},
+		{"\t\t", false},
+		{"bob smith", false},
+		{strings.Repeat("a", maxNameLen), true},
+		{strings.Repeat("a", maxNameLen+1), false},
+		{strings.Repeat("é", maxNameLen), true}, // counted in characters, not bytes
+		{"bob\n", false},
+		{"\x7fbob", false},
+	} {
+		if got := validName(tc.name); got != tc.want {
+			t.Errorf("validName(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNameAndMessageInOneWrite(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+
+	bob := dial(t, s)
+	if _, err := bob.conn.Write([]byte("bob\nhello everyone\n")); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect("You joined as bob")
+	alice.expect("bob has joined")
+	alice.expect("[bob]:hello everyone")
+}
+
+func TestNameTakenIgnoresCase(t *testing.T) {
+	s := startServer(t, nil)
+	join(t, s, "alice")
+
+	c := dial(t, s)
+	c.send("ALICE")
+	c.expect("Name already taken")
+	c.send("Alice")
+	c.expect("Name already taken")
+	c.send("alice2")
+	c.expect("You joined as alice2")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, name := range []string{"alice", "ALICE", "aLiCe"} {
+		if !s.nameTaken(name, nil) {
+			t.Errorf("nameTaken(%q) = false while alice is online", name)
+		}
+	}
+	if s.nameTaken("bob", nil) {
+		t.Error(`nameTaken("bob") = true`)
+	}
+}
+
+func TestSlowClientDropped(t *testing.T) {
+	s := NewServer(DefaultConfig())
+	room := s.getRoom(defaultRoom)
+	member := func(name string) (*client, net.Conn) {
+		server, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		c := s.newClient(server)
+		t.Cleanup(c.close)
+		c.name, c.room = name, room
+		s.clients[c] = true
+		room.members[c] = true
+		return c, peer
+	}
+	slow, slowPeer := member("slow") // never reads
+	_, fastPeer := member("fast")
+
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(fastPeer)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	// One line in the writer plus a full outbox, and one more to overflow
+	for i := 0; i < outboxSize+2; i++ {
+		s.announce(room, "tick", nil)
+		select {
+		case <-lines:
+		case <-time.After(testTimeout):
+			t.Fatalf("fast client stopped receiving after %d lines", i)
+		}
+	}
+
+	select {
+	case <-slow.done:
+	case <-time.After(testTimeout):
+		t.Fatal("slow client's writer still running")
+	}
+	slowPeer.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := slowPeer.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("slow client's connection not closed: %v", err)
+	}
+}
+
+func TestReservedNamesRefused(t *testing.T) {
+	for _, name := range []string{"Server", "server", "SYSTEM", "Admin", "ѕerver", lurkName} {
+		if !reservedName(name) {
+			t.Errorf("reservedName(%q) = false", name)
+		}
+	}
+	if reservedName("servers") {
+		t.Error(`reservedName("servers") = true`)
+	}
+
+	s := startServer(t, nil)
+	c := dial(t, s)
+	c.send("Server")
+	c.expect("That name is reserved")
+	c.send("bob")
+	c.expect("You joined as bob")
+
+	// The lurker sentinel works at the prompt but isn't a name
+	c.send("/nick " + lurkName)
+	c.expect("That name is reserved. Keeping bob.")
+	c.send("/nick Admin")
+	c.expect("That name is reserved. Keeping bob.")
+}
+
+func TestNameWithCommandPrefix(t *testing.T) {
+	for _, prefix := range []string{"/", "!"} {
+		s := startServer(t, func(cfg *Config) { cfg.CommandPrefix = prefix })
+		rule := s.prefixRule()
+		c := dial(t, s)
+		c.send(prefix + "bob")
+		c.expect(rule)
+		c.send("bob")
+		c.expect("You joined as bob")
+
+		c.send(prefix + "nick " + prefix + "robert")
+		c.expect(rule)
+		c.send(prefix + "list")
+		c.send(prefix + "ping done")
+		if out := c.expect("pong done"); strings.Contains(out, "robert") {
+			t.Errorf("prefix %q: renamed anyway: %q", prefix, out)
+		}
+	}
+}
+
+func TestAllowMessageBurst(t *testing.T) {
+	c := &client{}
+	now := time.Now()
+	allowed := 0
+	for i := 0; i < 3*rateLimit; i++ {
+		if c.allowMessage(now.Add(time.Duration(i) * time.Millisecond)) {
+			allowed++
+		}
+	}
+	if allowed != rateLimit {
+		t.Errorf("burst let %d messages through, want %d", allowed, rateLimit)
+	}
+	if !c.allowMessage(now.Add(rateWindow)) {
+		t.Error("message refused in the next window")
+	}
+}
+
+func TestBurstOverTheWire(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+
+	var burst strings.Builder
+	for i := 0; i < 3*rateLimit; i++ {
+		fmt.Fprintf(&burst, "message %d\n", i)
+	}
+	bob.conn.Write([]byte(burst.String()))
+	bob.expect("You're sending too fast")
+	if n := strings.Count(alice.quiet(500*time.Millisecond), "[bob]:message"); n != rateLimit {
+		t.Errorf("alice got %d of the burst, want %d", n, rateLimit)
+	}
+}
+
+func TestCRLFLineEndings(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	bob := dial(t, s)
+	bob.conn.Write([]byte("bob\r\n"))
+	bob.expect("You joined as bob")
+	alice.expect("bob has joined")
+
+	s.mutex.Lock()
+	c := s.findClient("bob")
+	s.mutex.Unlock()
+	if c == nil {
+		t.Fatal("bob not found")
+	}
+	if c.name != "bob" {
+		t.Fatalf("stored name %q, want %q", c.name, "bob")
+	}
+
+	bob.conn.Write([]byte("hi there\r\n"))
+	alice.expect("[bob]:hi there")
+	if strings.HasPrefix(alice.buf, "\r") {
+		t.Errorf("message kept its CR: %q", alice.buf)
+	}
+}
+
+func TestInvalidUTF8Dropped(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+
+	bob.conn.Write([]byte("bad \xff\xfe bytes\n"))
+	bob.expect("Message dropped: not valid UTF-8 text")
+	if out := alice.quiet(200 * time.Millisecond); strings.Contains(out, "bytes") {
+		t.Errorf("invalid line reached the room: %q", out)
+	}
+	bob.send("good bytes")
+	alice.expect("[bob]:good bytes")
+}
+
+func TestLookalikeNames(t *testing.T) {
+	// Go has no NFC normalization in the standard library, so instead of
+	// folding "e" + U+0301 into "é" the decomposed spelling is refused
+	precomposed, decomposed := "jos\u00e9", "jose\u0301"
+	if !validName(precomposed) {
+		t.Errorf("validName(%q) = false", precomposed)
+	}
+	if validName(decomposed) {
+		t.Errorf("validName(%q) = true, want combining marks refused", decomposed)
+	}
+	// Mixed alphabets are refused; a whole-script lookalike folds onto the
+	// Latin name
+	if validName("\u0430lice") {
+		t.Error("validName accepted a Latin name with a Cyrillic а")
+	}
+	if nameSkeleton("\u0430\u0441\u0435") != nameSkeleton("ace") {
+		t.Error("Cyrillic and Latin ace have different skeletons")
+	}
+
+	s := startServer(t, nil)
+	join(t, s, precomposed)
+	join(t, s, "ace")
+	c := dial(t, s)
+	c.send(decomposed)
+	c.expect(nameRule)
+	c.send("\u0430\u0441\u0435")
+	c.expect("Name already taken")
+}
+
+func TestNameEntryTimeout(t *testing.T) {
+	s := startServer(t, func(cfg *Config) { cfg.NameTimeout = 200 * time.Millisecond })
+	c := dial(t, s)
+	c.expect(s.cfg.NamePrompt)
+	c.expect("Name entry timed out")
+	c.expectClosed()
+
+	// The deadline covers the password prompt too, and the name is freed
+	s = startServer(t, func(cfg *Config) {
+		cfg.NameTimeout = 200 * time.Millisecond
+		cfg.Password = "pw"
+	})
+	c = dial(t, s)
+	c.send("bob")
+	c.expect("[PASSWORD]: ")
+	c.expect("Name entry timed out")
+	c.expectClosed()
+	c = dial(t, s)
+	c.send("bob")
+	c.send("pw")
+	c.expect("You joined as bob")
+}
+
+func TestTooManyNameAttempts(t *testing.T) {
+	s := startServer(t, nil)
+	join(t, s, "bob")
+
+	c := dial(t, s)
+	for i := 1; i < maxNameAttempts; i++ {
+		c.send("bob")
+		c.expect("Name already taken. Choose another name:")
+	}
+	c.send("carol")
+	c.expect("You joined as carol")
+
+	c = dial(t, s)
+	for i := 1; i <= maxNameAttempts; i++ {
+		c.send("bob")
+		c.expect("Name already taken")
+	}
+	c.expect("Too many invalid name attempts")
+	c.expectClosed()
+}
+
+func TestReserveNameRace(t *testing.T) {
+	s := NewServer(DefaultConfig())
+	for round := 0; round < 100; round++ {
+		name := fmt.Sprintf("bob%d", round)
+		var wins atomic.Int32
+		start := make(chan struct{})
+		done := make(chan struct{})
+		for _, try := range []string{name, strings.ToUpper(name)} {
+			go func() {
+				<-start
+				if s.reserveName(&client{srv: s}, try) {
+					wins.Add(1)
+				}
+				done <- struct{}{}
+			}()
+		}
+		close(start)
+		<-done
+		<-done
+		if n := wins.Load(); n != 1 {
+			t.Fatalf("%s: %d clients reserved it, want 1", name, n)
+		}
+	}
+
+	// The same over the wire: one joins, the other is asked again
+	srv := startServer(t, nil)
+	a, b := dial(t, srv), dial(t, srv)
+	a.expect(srv.cfg.NamePrompt)
+	b.expect(srv.cfg.NamePrompt)
+	a.send("carol")
+	b.send("carol")
+	joined := 0
+	for _, c := range []*testClient{a, b} {
+		for deadline := time.Now().Add(testTimeout); !strings.Contains(c.buf, "You joined as carol") && !strings.Contains(c.buf, "Name already taken"); {
+			if !c.read(deadline) {
+				t.Fatalf("no reply to the name, output %q", c.buf)
+			}
+		}
+		if strings.Contains(c.buf, "You joined as carol") {
+			joined++
+		}
+	}
+	if joined != 1 {
+		t.Errorf("%d clients joined as carol, want 1", joined)
+	}
+}
+
+func TestDisconnectDuringNaming(t *testing.T) {
+	s := NewServer(DefaultConfig())
+	conn, peer := net.Pipe()
+	cl := s.newClient(conn)
+	t.Cleanup(cl.close)
+	out := &testClient{t: t, conn: peer}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.getClientName(cl, bufio.NewScanner(conn))
+		done <- err
+	}()
+	out.expect(s.cfg.NamePrompt)
+	out.send("not a name!")
+	out.expect(nameRule)
+	peer.Close()
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("getClientName after disconnect = %v, want io.EOF", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("getClientName still waiting after disconnect")
+	}
+}
+
+// countingConn is a net.Conn that discards what is written to it and
+// counts the Write calls, i.e. the syscalls a real connection would make.
+type countingConn struct {
+	net.Conn // nil; only the methods below are used
+	writes   atomic.Int64
+	bytes    atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	c.bytes.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (c *countingConn) Close() error                     { return nil }
+func (c *countingConn) RemoteAddr() net.Addr             { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *countingConn) SetWriteDeadline(time.Time) error { return nil }
+
+// shortConn is a net.Conn that accepts at most max bytes per Write, like a
+// conn that returns short writes without an error. max 0 stalls it.
+type shortConn struct {
+	net.Conn // nil; only the methods below are used
+	max      int
+	mu       sync.Mutex
+	buf      strings.Builder
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p = p[:min(len(p), c.max)]
+	return c.buf.Write(p)
+}
+
+func (c *shortConn) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+func (c *shortConn) Close() error                     { return nil }
+func (c *shortConn) RemoteAddr() net.Addr             { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *shortConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestFullWriterRetriesShortWrites(t *testing.T) {
+	const line = "a line longer than one short write\n"
+	conn := &shortConn{max: 3}
+	if n, err := (fullWriter{conn}).Write([]byte(line)); n != len(line) || err != nil {
+		t.Fatalf("Write = %d, %v; want %d, nil", n, err, len(line))
+	}
+	if got := conn.String(); got != line {
+		t.Errorf("wrote %q, want %q", got, line)
+	}
+
+	stalled := &shortConn{max: 0}
+	if _, err := (fullWriter{stalled}).Write([]byte(line)); err != io.ErrShortWrite {
+		t.Errorf("Write with no progress = %v, want io.ErrShortWrite", err)
+	}
+
+	// Whole lines reach a client's conn, batched or not
+	for _, batch := range []time.Duration{0, time.Millisecond} {
+		s := NewServer(Config{WriteBatch: batch})
+		conn := &shortConn{max: 3}
+		cl := s.newClient(conn)
+		want := ""
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("line %d\n", i)
+			cl.send(msg)
+			want += msg
+		}
+		deadline := time.Now().Add(testTimeout)
+		for conn.String() != want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		cl.close()
+		if got := conn.String(); got != want {
+			t.Errorf("batch %v: conn got %q, want %q", batch, got, want)
+		}
+	}
+}
+
+// burstLines is how many lines a broadcast burst queues for one client,
+// well under outboxSize so the client is never dropped for being slow.
+const burstLines = 64
+
+// sendBurst queues burstLines lines for c and waits until conn has had
+// them all.
+func sendBurst(c *client, conn *countingConn) {
+	line := "[2026-01-01 00:00:00][alice]:a typical chat line\n"
+	want := conn.bytes.Load() + int64(burstLines*len(line))
+	for i := 0; i < burstLines; i++ {
+		c.send(line)
+	}
+	for conn.bytes.Load() < want {
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+func TestWriteBatchCoalesces(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WriteBatch = 20 * time.Millisecond
+	conn := &countingConn{}
+	c := NewServer(cfg).newClient(conn)
+	sendBurst(c, conn)
+	c.close()
+	<-c.done
+	if n := conn.writes.Load(); n >= burstLines/4 {
+		t.Errorf("%d writes for a burst of %d lines, want a few", n, burstLines)
+	}
+}
+
+// BenchmarkClientWrites reports the writes (syscalls) per burst of
+// burstLines lines with and without -batch.
+func BenchmarkClientWrites(b *testing.B) {
+	for _, batch := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond} {
+		b.Run("batch="+batch.String(), func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.WriteBatch = batch
+			conn := &countingConn{}
+			c := NewServer(cfg).newClient(conn)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sendBurst(c, conn)
+			}
+			b.StopTimer()
+			c.close()
+			<-c.done
+			b.ReportMetric(float64(conn.writes.Load())/float64(b.N), "writes/burst")
+		})
+	}
+}
+
+// BenchmarkBroadcast joins n clients to a server on a free port and times
+// broadcasts from one of them until every client has read each line. It
+// calls broadcast directly, since the per-client rate limit keeps a real
+// sender far below what the server can deliver.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{10, 50, 200} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			s := startServer(b, func(cfg *Config) {
+				cfg.MaxClients, cfg.MaxPerIP, cfg.ConnRate = n, n, 0
+				cfg.JoinReplay = 0
+			})
+			var received atomic.Int64
+			for i := 0; i < n; i++ {
+				c := join(b, s, fmt.Sprintf("user%d", i))
+				go func() {
+					r := bufio.NewReader(c.conn)
+					c.conn.SetReadDeadline(time.Time{})
+					for {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if strings.Contains(line, "bench line") {
+							received.Add(1)
+						}
+					}
+				}()
+			}
+			s.mutex.Lock()
+			sender := s.findClient("user0")
+			s.mutex.Unlock()
+
+			// Broadcast in bursts the outboxes can hold, so nobody is
+			// dropped as a slow client
+			const burst = outboxSize / 2
+			b.ResetTimer()
+			for sent := 0; sent < b.N; {
+				for i := 0; i < burst && sent < b.N; i++ {
+					s.broadcast(Message{Time: time.Now(), Sender: sender.name, Text: "bench line", Kind: KindChat}, sender)
+					sent++
+				}
+				for received.Load() < int64(sent*n) {
+					time.Sleep(50 * time.Microsecond)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N*n)/b.Elapsed().Seconds(), "deliveries/s")
+		})
+	}
+}
+
+func TestReplayColors(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+	bob.send("hello")
+	alice.expect("[bob]:hello")
+
+	carol := dial(t, s)
+	carol.send("carol")
+	carol.expect(s.cfg.NamePrompt)
+	replay := carol.expect("You joined as carol")
+	for _, tc := range []struct{ text, color string }{
+		{"bob has joined our chat...", ColorYellow},
+		{"[bob]:hello", ColorRed},
+	} {
+		i := strings.Index(replay, tc.text)
+		if i < 0 {
+			t.Fatalf("replay %q is missing %q", replay, tc.text)
+		}
+		line := replay[strings.LastIndex(replay[:i], "\n")+1 : i]
+		if !strings.HasPrefix(line, tc.color) {
+			t.Errorf("replayed %q starts %q, want color %q", tc.text, line, tc.color)
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+
+	alice.send("/ignore Bob")
+	alice.expect("Ignoring bob")
+	bob.send("public hello")
+	bob.expect("[bob]:public hello")
+	bob.send("/msg alice private hello")
+	bob.expect("private hello") // echoed as if delivered
+	alice.send("/ping done")
+	if out := alice.expect("pong done"); strings.Contains(out, "hello") {
+		t.Errorf("ignored user's messages arrived: %q", out)
+	}
+
+	alice.send("/unignore bob")
+	alice.expect("No longer ignoring bob")
+	bob.send("/msg alice hi again")
+	alice.expect("hi again")
+	bob.send("public again")
+	alice.expect("[bob]:public again")
+}
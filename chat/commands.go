@@ -0,0 +1,563 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// -----------------------------
+// COMMANDS
+// -----------------------------
+// command is a chat command. Handlers run on the client's own goroutine
+// and write their replies themselves.
+type command struct {
+	name      string
+	args      string // argument synopsis for /help and usage hints
+	help      string
+	adminOnly bool
+	handler   func(cl *client, args string)
+}
+
+// maxTopicLen is the longest room topic, in characters.
+const maxTopicLen = 200
+
+// commands is the registry used by dispatchCommand and /help, keyed by
+// name. It is filled in init and read-only afterwards.
+var commands = make(map[string]*command)
+
+func init() {
+	for _, c := range []*command{
+		{name: "away", args: "[reason]", help: "Mark yourself as away", handler: cmdAway},
+		{name: "back", help: "Clear your away status", handler: cmdBack},
+		{name: "ban", args: "<name>", help: "Kick a user and ban their IP", adminOnly: true, handler: cmdBan},
+		{name: "broadcast", args: "<text>", help: "Send a server notice to every room", adminOnly: true, handler: cmdBroadcast},
+		{name: "clear", help: "Clear your screen", handler: cmdClear},
+		{name: "color", args: "[name]", help: "Pick the color others see your messages in", handler: cmdColor},
+		{name: "drain", help: "Stop admitting new connections before a restart", adminOnly: true, handler: cmdDrain},
+		{name: "echo", args: "<text>", help: "Send text back to you only, as the server cleaned it", handler: cmdEcho},
+		{name: "emoji", args: "on|off", help: "Show shortcodes such as :shrug: as emoji, or as typed", handler: cmdEmoji},
+		{name: "help", help: "Show this help", handler: cmdHelp},
+		{name: "history", args: "[n]", help: "Show the last n messages of your room (default 20)", handler: cmdHistory},
+		{name: "ignore", args: "[name]", help: "Hide a user's messages, or list ignored users", handler: cmdIgnore},
+		{name: "info", args: "<name>", help: "Show a user's join time, room, away status and role", handler: cmdInfo},
+		{name: "join", args: "<room>", help: "Move to another room, creating it if needed", handler: cmdJoin},
+		{name: "json", args: "on|off", help: "Receive messages as one JSON object per line", handler: cmdJSON},
+		{name: "kick", args: "<name>", help: "Disconnect a user", adminOnly: true, handler: cmdKick},
+		{name: "list", help: "Show who is in your room", handler: cmdList},
+		{name: "login", args: "<password>", help: "Log in as admin", handler: cmdLogin},
+		{name: "me", args: "<action>", help: "Describe an action in the third person", handler: cmdMe},
+		{name: "mentions", args: "on|off", help: "Ring the bell and highlight messages with @yourname", handler: cmdMentions},
+		{name: "msg", args: "<name> <text>", help: "Send a private message", handler: cmdMsg},
+		{name: "mute", help: "Stop receiving room messages until /unmute", handler: cmdMute},
+		{name: "nick", args: "<newname>", help: "Change your name", handler: cmdNick},
+		{name: "paste", help: "Send the lines that follow, up to /end, as one message", handler: cmdPaste},
+		{name: "ping", args: "[token]", help: "Check the server responds; the reply repeats token", handler: cmdPing},
+		{name: "quit", help: "Leave the chat", handler: cmdQuit},
+		{name: "recent", help: "Show who left most recently", handler: cmdRecent},
+		{name: "roll", args: "[NdM]", help: "Roll dice, e.g. 2d6 (default 1d6)", handler: cmdRoll},
+		{name: "rooms", help: "List active rooms", handler: cmdRooms},
+		{name: "seen", args: "<name>", help: "Show when a user last sent a message", handler: cmdSeen},
+		{name: "shrug", args: "[text]", help: `Send text followed by ¯\_(ツ)_/¯`, handler: cmdShrug},
+		{name: "shutdown", help: "Disconnect everyone and stop the server", adminOnly: true, handler: cmdShutdown},
+		{name: "stats", help: "Show server statistics", handler: cmdStats},
+		{name: "time", help: "Show the server's current time", handler: cmdTime},
+		{name: "timestamps", args: "on|off", help: "Show or hide message timestamps", handler: cmdTimestamps},
+		{name: "topic", args: "[text]", help: "Show the room topic, or set it (admin)", handler: cmdTopic},
+		{name: "unban", args: "<ip>", help: "Lift an IP ban", adminOnly: true, handler: cmdUnban},
+		{name: "unignore", args: "<name>", help: "Show a user's messages again", handler: cmdUnignore},
+		{name: "unmute", help: "Receive room messages again", handler: cmdUnmute},
+		{name: "uptime", help: "Show how long the server has been running", handler: cmdUptime},
+		{name: "whoami", help: "Show your name, room and away status", handler: cmdWhoami},
+		{name: "whois", args: "<name>", help: "Show when a user connected, and from where to admins", handler: cmdWhois},
+	} {
+		commands[c.name] = c
+	}
+}
+
+// parseCommand splits text into a lower-cased command name and its
+// trimmed arguments. For a line that isn't a command it returns the text
+// to send, with a doubled prefix collapsed to one ("//x" sends "/x").
+func (s *Server) parseCommand(text string) (cmd, args string, isCommand bool) {
+	if !strings.HasPrefix(text, s.cfg.CommandPrefix) {
+		return "", text, false
+	}
+	rest := text[len(s.cfg.CommandPrefix):]
+	if strings.HasPrefix(rest, s.cfg.CommandPrefix) {
+		return "", rest, false
+	}
+	cmd, args, _ = strings.Cut(rest, " ")
+	return strings.ToLower(cmd), strings.TrimSpace(args), true
+}
+
+// dispatchCommand runs the command on line for cl. It reports false when
+// line isn't a command, leaving the text to send (escape removed) in text.
+func (s *Server) dispatchCommand(cl *client, line string) (text string, handled bool) {
+	name, args, isCommand := s.parseCommand(line)
+	if !isCommand {
+		return args, false
+	}
+	c := commands[name]
+	if c == nil {
+		cl.send(fmt.Sprintf("Unknown command %s%s. Type %shelp for a list, or start a message with %s%s to send it as text.\n",
+			s.cfg.CommandPrefix, name, s.cfg.CommandPrefix, s.cfg.CommandPrefix, s.cfg.CommandPrefix))
+		return "", true
+	}
+	if c.adminOnly {
+		s.mutex.Lock()
+		isAdmin := cl.isAdmin
+		s.mutex.Unlock()
+		if !isAdmin {
+			cl.send("Permission denied\n")
+			return "", true
+		}
+	}
+	c.handler(cl, args)
+	return "", true
+}
+
+// usageReply renders the usage hint for the command called name.
+func (s *Server) usageReply(name string) string {
+	c := commands[name]
+	return "Usage: " + s.cfg.CommandPrefix + strings.TrimSpace(c.name+" "+c.args) + "\n"
+}
+
+// -----------------------------
+// HELP TEXT (/help)
+// -----------------------------
+func (s *Server) helpText() string {
+	names := make([]string, 0, len(commands))
+	width := 0
+	for name, c := range commands {
+		names = append(names, name)
+		if n := len(c.name) + 1 + len(c.args); n > width {
+			width = n
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Available commands:\n")
+	for _, name := range names {
+		c := commands[name]
+		help := c.help
+		if c.adminOnly {
+			help += " (admin)"
+		}
+		fmt.Fprintf(&b, "  %s%-*s  %s\n", s.cfg.CommandPrefix, width, c.name+" "+c.args, help)
+	}
+	fmt.Fprintf(&b, "Start a message with %s%s to send text beginning with %s.\n", s.cfg.CommandPrefix, s.cfg.CommandPrefix, s.cfg.CommandPrefix)
+	return b.String()
+}
+
+// -----------------------------
+// COMMAND HANDLERS
+// -----------------------------
+func cmdQuit(cl *client, args string) {
+	cl.send("Goodbye " + cl.name + "!\n")
+	cl.quit = true
+}
+
+func cmdNick(cl *client, args string) {
+	s := cl.srv
+	if strings.HasPrefix(args, s.cfg.CommandPrefix) {
+		cl.send(s.prefixRule() + "\n")
+		return
+	}
+	if !validName(args) {
+		cl.send(nameRule + "\n")
+		return
+	}
+	if reservedName(args) {
+		cl.send("That name is reserved. Keeping " + cl.name + ".\n")
+		return
+	}
+	oldName, ok := s.renameClient(cl, args)
+	if !ok {
+		cl.send("Name already taken. Keeping " + cl.name + ".\n")
+		return
+	}
+	s.announce(s.currentRoom(cl), fmt.Sprintf("%s is now known as %s", oldName, args), nil)
+}
+
+func cmdPaste(cl *client, args string) {
+	cl.startPaste()
+}
+
+// cmdPing answers at once. A client can send a timestamp as token and
+// measure the round trip from the reply.
+func cmdPing(cl *client, args string) {
+	cl.send(strings.TrimSpace("pong "+args) + "\n")
+}
+
+// cmdEcho returns args to the requester alone. The line has already been
+// through the same sanitize and trim as a chat message, so the reply shows
+// exactly what the server would have sent on.
+func cmdEcho(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("echo"))
+		return
+	}
+	cl.send(args + "\n")
+}
+
+func cmdHelp(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.helpText())
+}
+
+func cmdHistory(cl *client, args string) {
+	s := cl.srv
+	n := defaultHistoryLines
+	if args != "" {
+		v, err := strconv.Atoi(args)
+		if err != nil || v < 1 {
+			cl.send(s.usageReply("history"))
+			return
+		}
+		n = v
+	}
+	history := s.recentHistory(cl, n)
+	if history == "" {
+		history = "No messages yet\n"
+	}
+	cl.send(history)
+}
+
+func cmdList(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.listClients(cl) + "\n")
+}
+
+func cmdAway(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.setAway(cl, args) + "\n")
+}
+
+func cmdBack(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.clearAway(cl) + "\n")
+}
+
+func cmdColor(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.setColor(cl, args) + "\n")
+}
+
+func cmdMute(cl *client, args string) {
+	s := cl.srv
+	s.mutex.Lock()
+	cl.muted = true
+	s.mutex.Unlock()
+	cl.send("Muted. You won't see room messages until " + s.cfg.CommandPrefix + "unmute.\n")
+}
+
+func cmdUnmute(cl *client, args string) {
+	s := cl.srv
+	s.mutex.Lock()
+	cl.muted = false
+	s.mutex.Unlock()
+	cl.send("Unmuted\n")
+}
+
+func cmdRooms(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.listRooms())
+}
+
+func cmdJoin(cl *client, args string) {
+	s := cl.srv
+	target := strings.ToLower(strings.TrimPrefix(args, "#"))
+	if !validName(target) {
+		cl.send(roomRule + "\n")
+		return
+	}
+	from, to := s.moveClient(cl, target)
+	if to == nil {
+		return // already gone
+	}
+	if from == to {
+		cl.send("You are already in #" + to.name + "\n")
+		return
+	}
+	// Catch up on the new room only; history never crosses rooms
+	if history := s.recentHistory(cl, defaultHistoryLines); history != "" {
+		cl.send(history)
+	}
+	s.announce(from, fmt.Sprintf("%s has left for #%s", cl.name, to.name), nil)
+	s.announce(to, fmt.Sprintf("%s has joined #%s", cl.name, to.name), nil)
+	s.mutex.Lock()
+	if topic := s.topicLine(to); topic != "" {
+		cl.send(topic)
+	}
+	s.mutex.Unlock()
+}
+
+func cmdTopic(cl *client, args string) {
+	s := cl.srv
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	room := cl.room
+	switch {
+	case args == "" && room.topic == "":
+		cl.send("#" + room.name + " has no topic\n")
+	case args == "":
+		cl.send("Topic of #" + room.name + ": " + room.topic + "\n")
+	case !cl.isAdmin:
+		cl.send("Permission denied\n")
+	case utf8.RuneCountInString(args) > maxTopicLen:
+		cl.send(fmt.Sprintf("Topic too long (max %d chars)\n", maxTopicLen))
+	default:
+		room.topic = args
+		s.announceLocked(room, fmt.Sprintf("%s changed the topic to: %s", cl.name, args), nil)
+	}
+}
+
+func cmdMsg(cl *client, args string) {
+	s := cl.srv
+	to, body, _ := strings.Cut(args, " ")
+	body = strings.TrimSpace(body)
+	if to == "" || body == "" {
+		cl.send(s.usageReply("msg"))
+		return
+	}
+	if !s.sendPrivate(cl, cl.name, to, body) {
+		cl.send("No such user: " + to + "\n")
+	}
+}
+
+func cmdWhois(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("whois"))
+		return
+	}
+	cl.send(s.whois(cl, args) + "\n")
+}
+
+func cmdInfo(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("info"))
+		return
+	}
+	cl.send(s.info(cl, args))
+}
+
+func cmdWhoami(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.whoami(cl))
+}
+
+func cmdRecent(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.recent())
+}
+
+func cmdSeen(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("seen"))
+		return
+	}
+	cl.send(s.seen(args) + "\n")
+}
+
+func cmdClear(cl *client, args string) {
+	cl.send(ClearScreen)
+}
+
+func cmdTimestamps(cl *client, args string) {
+	s := cl.srv
+	if args != "on" && args != "off" {
+		cl.send(s.usageReply("timestamps"))
+		return
+	}
+	s.mutex.Lock()
+	cl.showTime = args == "on"
+	s.mutex.Unlock()
+	cl.send("Timestamps " + args + "\n")
+}
+
+// cmdTime shows the time in the layout and zone used for message
+// timestamps, naming the zone since the layout may not.
+func cmdTime(cl *client, args string) {
+	s := cl.srv
+	now := time.Now()
+	if s.cfg.UTC {
+		now = now.UTC()
+	}
+	zone, _ := now.Zone()
+	cl.send("Server time: " + s.formatTime(now) + " " + zone + "\n")
+}
+
+func cmdUptime(cl *client, args string) {
+	s := cl.srv
+	s.mutex.Lock()
+	up := time.Since(s.startTime)
+	s.mutex.Unlock()
+	cl.send("Server up for " + formatUptime(up) + "\n")
+}
+
+func cmdStats(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.stats() + "\n")
+}
+
+func cmdIgnore(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.listIgnored(cl) + "\n")
+		return
+	}
+	cl.send(s.ignoreUser(cl, args) + "\n")
+}
+
+func cmdUnignore(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("unignore"))
+		return
+	}
+	cl.send(s.unignoreUser(cl, args) + "\n")
+}
+
+func cmdLogin(cl *client, args string) {
+	s := cl.srv
+	cl.send(s.login(cl, args) + "\n")
+}
+
+func cmdKick(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("kick"))
+		return
+	}
+	if reply := s.kick(cl, args); reply != "" {
+		cl.send(reply + "\n")
+	}
+}
+
+func cmdBan(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("ban"))
+		return
+	}
+	if reply := s.ban(cl, args); reply != "" {
+		cl.send(reply + "\n")
+	}
+}
+
+func cmdUnban(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("unban"))
+		return
+	}
+	cl.send(s.unban(cl, args) + "\n")
+}
+
+func cmdBroadcast(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("broadcast"))
+		return
+	}
+	s.logEvent("NOTICE", "%s: %s", cl.name, args)
+	s.serverNotice(args)
+}
+
+func cmdDrain(cl *client, args string) {
+	s := cl.srv
+	s.mutex.Lock()
+	already := s.draining
+	s.draining = true
+	s.mutex.Unlock()
+	if already {
+		cl.send("Already draining\n")
+		return
+	}
+	s.logEvent("DRAIN", "started by %s", cl.name)
+	s.serverNotice("The server will restart soon. New connections are no longer accepted.")
+}
+
+func cmdShutdown(cl *client, args string) {
+	s := cl.srv
+	s.logEvent("SHUTDOWN", "requested by %s", cl.name)
+	// Not on this goroutine: Stop waits for every writer, ours included
+	go s.Stop()
+}
+
+func cmdMe(cl *client, args string) {
+	s := cl.srv
+	if args == "" {
+		cl.send(s.usageReply("me"))
+		return
+	}
+	// Keyed apart from a plain line with the same words
+	if !cl.isRepeat(s.cfg.CommandPrefix+"me "+args, time.Now()) && allowPublic(cl, args) {
+		s.emote(cl, args)
+		cl.countPublic()
+	}
+}
+
+func cmdShrug(cl *client, args string) {
+	s := cl.srv
+	text := strings.TrimSpace(args + " " + shortcodes[":shrug:"])
+	if !cl.isRepeat(text, time.Now()) && allowPublic(cl, text) {
+		s.broadcast(Message{Time: time.Now(), Sender: cl.name, Text: text, Kind: KindChat}, cl)
+		cl.countPublic()
+	}
+}
+
+func cmdEmoji(cl *client, args string) {
+	s := cl.srv
+	if args != "on" && args != "off" {
+		cl.send(s.usageReply("emoji"))
+		return
+	}
+	s.mutex.Lock()
+	cl.emoji = args == "on"
+	s.mutex.Unlock()
+	cl.send("Emoji " + args + "\n")
+}
+
+func cmdMentions(cl *client, args string) {
+	s := cl.srv
+	if args != "on" && args != "off" {
+		cl.send(s.usageReply("mentions"))
+		return
+	}
+	s.mutex.Lock()
+	cl.mentions = args == "on"
+	s.mutex.Unlock()
+	cl.send("Mentions " + args + "\n")
+}
+
+func cmdJSON(cl *client, args string) {
+	s := cl.srv
+	if args != "on" && args != "off" {
+		cl.send(s.usageReply("json"))
+		return
+	}
+	cl.jsonMode.Store(args == "on")
+	cl.send("JSON mode " + args + "\n")
+}
+
+func cmdRoll(cl *client, args string) {
+	s := cl.srv
+	result, ok := roll(args)
+	if !ok {
+		cl.send(fmt.Sprintf("Usage: %sroll [NdM], at most %d dice of %d sides\n", s.cfg.CommandPrefix, maxDice, maxDieSides))
+		return
+	}
+	if allowPublic(cl, args) {
+		s.announce(s.currentRoom(cl), cl.name+" rolled "+result, nil)
+		cl.countPublic()
+	}
+}
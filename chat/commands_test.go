@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, text string
+		cmd, args    string
+		isCommand    bool
+	}{
+		{"/", "hello", "", "hello", false},
+		{"/", "/nick  bob ", "nick", "bob", true},
+		{"/", "/WHO", "who", "", true},
+		{"/", "//nick bob", "", "/nick bob", false},
+		{"/", "//", "", "/", false},
+		{"/", "/", "", "", true},
+		{"/", "a /b", "", "a /b", false},
+		{"!", "!msg bob hi", "msg", "bob hi", true},
+		{"!", "!!msg", "", "!msg", false},
+		{"!", "/nick bob", "", "/nick bob", false},
+		{"::", "::me waves", "me", "waves", true},
+		{"::", ":::me", ":me", "", true},
+		{"::", "::::me", "", "::me", false},
+	} {
+		s := NewServer(Config{CommandPrefix: tc.prefix})
+		cmd, args, isCommand := s.parseCommand(tc.text)
+		if cmd != tc.cmd || args != tc.args || isCommand != tc.isCommand {
+			t.Errorf("prefix %q: parseCommand(%q) = %q, %q, %v; want %q, %q, %v",
+				tc.prefix, tc.text, cmd, args, isCommand, tc.cmd, tc.args, tc.isCommand)
+		}
+	}
+}
+
+func TestEscapedPrefixSentAsMessage(t *testing.T) {
+	s := startServer(t, func(cfg *Config) { cfg.CommandPrefix = "!" })
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+
+	bob.send("!!help is a command")
+	alice.expect("[bob]:!help is a command")
+	bob.send("/help is text with this prefix")
+	alice.expect("[bob]:/help is text with this prefix")
+}
+
+func TestDispatchCommand(t *testing.T) {
+	s := NewServer(DefaultConfig())
+	conn, peer := net.Pipe()
+	cl := s.newClient(conn)
+	t.Cleanup(cl.close)
+	out := &testClient{t: t, conn: peer}
+
+	for _, tc := range []struct {
+		line, text string
+		handled    bool
+		reply      string
+	}{
+		{"/ping abc", "", true, "pong abc\n"},
+		{"/PING", "", true, "pong\n"},
+		{"/echo  spaced ", "", true, "spaced\n"},
+		{"/roll 0d0", "", true, "Usage: /roll [NdM]"},
+		{"/frob x", "", true, "Unknown command /frob. Type /help for a list, or start a message with // to send it as text.\n"},
+		{"hello", "hello", false, ""},
+		{"//ping", "/ping", false, ""},
+	} {
+		text, handled := s.dispatchCommand(cl, tc.line)
+		if text != tc.text || handled != tc.handled {
+			t.Errorf("dispatchCommand(%q) = %q, %v; want %q, %v", tc.line, text, handled, tc.text, tc.handled)
+		}
+		if tc.reply != "" {
+			out.expect(tc.reply)
+		} else if got := out.quiet(50 * time.Millisecond); got != "" {
+			t.Errorf("%q got reply %q, want none", tc.line, got)
+		}
+	}
+}
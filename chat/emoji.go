@@ -0,0 +1,37 @@
+package chat
+
+import (
+	"strings"
+	"sync"
+)
+
+// -----------------------------
+// SHORTCODES (/emoji)
+// -----------------------------
+// shortcodes are expanded in chat and emote text when shown to clients
+// that have /emoji on. Add entries here; values are sanitized like input.
+var shortcodes = map[string]string{
+	":shrug:": `¯\_(ツ)_/¯`,
+	":)":      "😊",
+	":(":      "🙁",
+	":D":      "😄",
+	";)":      "😉",
+	":heart:": "❤️",
+	":+1:":    "👍",
+	":fire:":  "🔥",
+	":tada:":  "🎉",
+}
+
+// shortcodeReplacer is built from shortcodes on first use.
+var shortcodeReplacer = sync.OnceValue(func() *strings.Replacer {
+	pairs := make([]string, 0, 2*len(shortcodes))
+	for code, text := range shortcodes {
+		pairs = append(pairs, code, sanitize(text))
+	}
+	return strings.NewReplacer(pairs...)
+})
+
+// expandShortcodes replaces every shortcode in s.
+func expandShortcodes(s string) string {
+	return shortcodeReplacer().Replace(s)
+}
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"net"
+	"time"
+)
+
+// -----------------------------
+// CONNECTION FLOOD PROTECTION (-connrate)
+// -----------------------------
+// An IP that opens more than ConnRate connections within ConnWindow is
+// refused for connBackoff. The check runs in the accept loop, so refused
+// connections never get a goroutine.
+
+// Defaults for -connrate and -connwindow: generous enough for a few people
+// behind one NAT reconnecting, far below what a script produces.
+const (
+	defaultConnRate   = 20
+	defaultConnWindow = 10 * time.Second
+)
+
+// connBackoff is how long an IP that exceeded -connrate is refused.
+const connBackoff = 30 * time.Second
+
+// connAttempts counts one IP's connections in its current window.
+type connAttempts struct {
+	windowStart time.Time
+	count       int
+	refuseUntil time.Time
+}
+
+// allowConnect records a connection attempt from addr and reports whether
+// it may go on to admit. The first refusal of a backoff is logged; the rest
+// are dropped quietly so a flood doesn't flood the log too.
+func (s *Server) allowConnect(addr net.Addr, now time.Time) bool {
+	if s.cfg.ConnRate == 0 {
+		return true
+	}
+	ip := hostOf(addr.String())
+
+	s.mutex.Lock()
+	s.pruneConnAttempts(now)
+	a := s.connAttempts[ip]
+	if a == nil {
+		a = &connAttempts{windowStart: now}
+		s.connAttempts[ip] = a
+	}
+	if now.Before(a.refuseUntil) {
+		s.mutex.Unlock()
+		return false
+	}
+	if now.Sub(a.windowStart) >= s.cfg.ConnWindow {
+		a.windowStart, a.count = now, 0
+	}
+	a.count++
+	if a.count <= s.cfg.ConnRate {
+		s.mutex.Unlock()
+		return true
+	}
+	a.refuseUntil = now.Add(connBackoff)
+	s.mutex.Unlock()
+
+	s.logEvent("FLOOD", "%s refused for %s, over %d connections in %s", ip, connBackoff, s.cfg.ConnRate, s.cfg.ConnWindow)
+	return false
+}
+
+// pruneConnAttempts drops IPs whose window and backoff are both over. It
+// sweeps at most once per window. Caller must hold mutex.
+func (s *Server) pruneConnAttempts(now time.Time) {
+	if now.Sub(s.lastConnPrune) < s.cfg.ConnWindow {
+		return
+	}
+	s.lastConnPrune = now
+	for ip, a := range s.connAttempts {
+		if now.Sub(a.windowStart) >= s.cfg.ConnWindow && !now.Before(a.refuseUntil) {
+			delete(s.connAttempts, ip)
+		}
+	}
+}
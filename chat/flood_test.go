@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAllowConnectRapidReconnects(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ConnRate, cfg.ConnWindow = 3, time.Second
+	s := NewServer(cfg)
+	s.eventLog = log.New(io.Discard, "", 0)
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}
+
+	now := time.Now()
+	for i := 0; i < cfg.ConnRate; i++ {
+		if !s.allowConnect(addr, now.Add(time.Duration(i)*time.Millisecond)) {
+			t.Fatalf("connection %d refused, want the first %d allowed", i+1, cfg.ConnRate)
+		}
+	}
+	if s.allowConnect(addr, now.Add(10*time.Millisecond)) {
+		t.Fatal("connection over the rate allowed")
+	}
+	if !s.allowConnect(other, now.Add(10*time.Millisecond)) {
+		t.Fatal("another IP refused")
+	}
+
+	// The backoff outlasts the window
+	if s.allowConnect(addr, now.Add(2*time.Second)) {
+		t.Fatal("connection allowed during backoff")
+	}
+	if !s.allowConnect(addr, now.Add(connBackoff+time.Second)) {
+		t.Fatal("connection refused after backoff")
+	}
+}
+
+func TestAllowConnectPrunesStaleEntries(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ConnRate, cfg.ConnWindow = 3, time.Second
+	s := NewServer(cfg)
+
+	now := time.Now()
+	s.allowConnect(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, now)
+	s.allowConnect(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2)}, now.Add(2*time.Second))
+	if _, ok := s.connAttempts["10.0.0.1"]; ok {
+		t.Error("stale entry kept after its window")
+	}
+	if _, ok := s.connAttempts["10.0.0.2"]; !ok {
+		t.Error("current entry missing")
+	}
+}
+
+func TestAllowConnectDisabled(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ConnRate = 0
+	s := NewServer(cfg)
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	for i := 0; i < 100; i++ {
+		if !s.allowConnect(addr, time.Now()) {
+			t.Fatal("refused with -connrate 0")
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// -----------------------------
+// HTTP STATUS SERVER
+// -----------------------------
+// startHTTP serves the monitoring endpoints on addr in the background.
+func (s *Server) startHTTP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.eventLog.Printf("HTTP status on %s", ln.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.http = &http.Server{Handler: mux}
+	go s.http.Serve(ln)
+	return nil
+}
+
+// status is the JSON body served at /status.
+type status struct {
+	Clients       []string `json:"clients"`
+	ClientCount   int      `json:"client_count"`
+	MessageCount  int      `json:"message_count"`
+	Uptime        string   `json:"uptime"`
+	UptimeSeconds int64    `json:"uptime_seconds"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	st := status{
+		Clients:      make([]string, 0, len(s.clients)),
+		ClientCount:  len(s.clients),
+		MessageCount: s.totalMessages,
+	}
+	for c := range s.clients {
+		st.Clients = append(st.Clients, c.name)
+	}
+	s.mutex.Unlock()
+
+	sort.Strings(st.Clients)
+	uptime := time.Since(s.startTime)
+	st.Uptime = formatUptime(uptime)
+	st.UptimeSeconds = int64(uptime.Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleMetrics serves counters in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	metrics := []struct {
+		name, kind, help string
+		value            int
+	}{
+		{"chat_messages_total", "counter", "Chat messages broadcast since start.", s.totalMessages},
+		{"chat_connections_total", "counter", "Connections accepted since start.", s.totalConnections},
+		{"chat_clients_current", "gauge", "Clients currently in the chat.", len(s.clients)},
+		{"chat_rejected_full_total", "counter", "Connections rejected because the server was full.", s.rejectedFull},
+	}
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
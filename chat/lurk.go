@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// LURKERS (receive-only clients)
+// -----------------------------
+// lurkName entered at the name prompt joins as a lurker: the client sees
+// the default room but takes no name, doesn't count against MaxClients,
+// isn't listed and can't send anything.
+const lurkName = "-"
+
+const defaultMaxLurkers = 10
+
+// lurk runs a lurker's session until it disconnects or sends /quit. Every
+// other line is ignored.
+func (s *Server) lurk(cl *client, scanner *bufio.Scanner) {
+	s.mutex.Lock()
+	if len(s.lurkers) >= s.cfg.MaxLurkers {
+		s.mutex.Unlock()
+		cl.send(fmt.Sprintf("Too many lurkers (max %d). Try again later.\n", s.cfg.MaxLurkers))
+		s.logEvent("FULL", "%s lurker rejected, %d/%d", cl.addr, s.cfg.MaxLurkers, s.cfg.MaxLurkers)
+		return
+	}
+	cl.joinedAt = time.Now()
+	s.lurkers[cl] = true
+	room := s.getRoom(defaultRoom)
+	room.members[cl] = true
+	cl.room = room
+	if history := s.historyLocked(cl, s.cfg.JoinReplay); history != "" {
+		cl.send(history)
+	}
+	s.mutex.Unlock()
+
+	cl.send(s.colorize(ColorYellow, "You are lurking: you see #"+defaultRoom+" but can't send. Type "+s.cfg.CommandPrefix+"quit to leave.") + "\n")
+	s.logEvent("JOIN", "%s joined as a lurker", cl.addr)
+
+	// Lurkers may stay silent forever; keepalive still reaps dead peers
+	cl.conn.SetReadDeadline(time.Time{})
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == s.cfg.CommandPrefix+"quit" {
+			break
+		}
+	}
+
+	s.mutex.Lock()
+	delete(s.lurkers, cl)
+	s.leaveRoom(cl)
+	s.mutex.Unlock()
+	s.logEvent("LEAVE", "%s (lurker) left", cl.addr)
+}
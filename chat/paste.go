@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// -----------------------------
+// PASTE BLOCKS (/paste ... /end)
+// -----------------------------
+// A paste block collects lines until one reading just <prefix>end and then
+// broadcasts them as a single message, so a multi-line paste doesn't
+// interleave with other people's messages.
+const (
+	maxPasteLines = 50
+	maxPasteLen   = 8 * 1024 // characters, newlines included
+)
+
+// pasteEnd is the line that closes a paste block.
+func (s *Server) pasteEnd() string {
+	return s.cfg.CommandPrefix + "end"
+}
+
+// startPaste opens a paste block for c.
+func (c *client) startPaste() {
+	s := c.srv
+	c.pasting, c.paste, c.pasteLen = true, nil, 0
+	c.send(fmt.Sprintf("Pasting: enter up to %d lines, then %s on a line of its own\n", maxPasteLines, s.pasteEnd()))
+}
+
+// pasteLine adds line to c's open paste block. When the block ends it
+// returns the whole block and done, with block "" if nothing is left to
+// send. A block that grows too large is discarded. Lines keep their
+// indentation; trailing spaces and blank lines at either end are dropped.
+func (c *client) pasteLine(line string) (block string, done bool) {
+	s := c.srv
+	line = strings.TrimRight(line, " ")
+	if strings.TrimSpace(line) == s.pasteEnd() {
+		c.pasting = false
+		block = strings.Trim(strings.Join(c.paste, "\n"), "\n")
+		c.paste = nil
+		if block == "" {
+			c.send("Nothing pasted\n")
+		}
+		return block, true
+	}
+	c.paste = append(c.paste, line)
+	c.pasteLen += utf8.RuneCountInString(line) + 1
+	if len(c.paste) > maxPasteLines || c.pasteLen > maxPasteLen {
+		c.pasting, c.paste = false, nil
+		c.send(fmt.Sprintf("Paste too long (max %d lines, %d chars), discarded\n", maxPasteLines, maxPasteLen))
+		return "", true
+	}
+	return "", false
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// -----------------------------
+// WAITING QUEUE (-queue)
+// -----------------------------
+// When the server is full, up to QueueSize connections wait in line and
+// are admitted in arrival order as clients leave. The rest are rejected.
+
+// waiter is a connection waiting for a slot. ready is closed when it
+// reaches the front of the queue and a slot opens.
+type waiter struct {
+	conn  net.Conn
+	ready chan struct{}
+}
+
+// enqueue adds conn to the back of the queue and returns its waiter, or
+// nil if the queue is full. Caller must hold mutex.
+func (s *Server) enqueue(conn net.Conn) *waiter {
+	if len(s.waitQueue) >= s.cfg.QueueSize {
+		return nil
+	}
+	w := &waiter{conn: conn, ready: make(chan struct{})}
+	s.waitQueue = append(s.waitQueue, w)
+	return w
+}
+
+// admitWaiter hands a freed slot to the oldest waiter. Caller must hold
+// mutex and call it whenever a client leaves clients.
+func (s *Server) admitWaiter() {
+	if len(s.waitQueue) == 0 {
+		return
+	}
+	w := s.waitQueue[0]
+	s.waitQueue = s.waitQueue[1:]
+	close(w.ready)
+}
+
+// dequeue removes w from the queue, reporting false if it had already been
+// admitted. Caller must hold mutex.
+func (s *Server) dequeue(w *waiter) bool {
+	for i, q := range s.waitQueue {
+		if q == w {
+			s.waitQueue = append(s.waitQueue[:i], s.waitQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// waitForSlot blocks until w is admitted or its connection drops, and
+// reports whether it was admitted. Input sent while waiting is discarded;
+// reading it is how a hangup is noticed.
+func (s *Server) waitForSlot(w *waiter, position int) bool {
+	writeNotice(w.conn, fmt.Sprintf("Server full (%d/%d). You are number %d in line; please wait...\n", s.cfg.MaxClients, s.cfg.MaxClients, position))
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		buf := make([]byte, 512)
+		for {
+			if _, err := w.conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-w.ready:
+		// Stop the watcher, then give the connection back to the caller
+		w.conn.SetReadDeadline(time.Now())
+		<-gone
+		w.conn.SetReadDeadline(time.Time{})
+		writeNotice(w.conn, "A slot opened, you're now in\n")
+		return true
+	case <-gone:
+		s.mutex.Lock()
+		if !s.dequeue(w) {
+			// Admitted just as it hung up; pass the slot on
+			s.admitWaiter()
+		}
+		s.mutex.Unlock()
+		s.logEvent("QUEUE", "%s left the queue", w.conn.RemoteAddr())
+		w.conn.Close()
+		return false
+	}
+}
+
+// closeWaiters drops every queued connection at shutdown. Caller must hold
+// mutex.
+func (s *Server) closeWaiters() {
+	for _, w := range s.waitQueue {
+		writeNotice(w.conn, "Server is shutting down\n")
+		w.conn.Close()
+	}
+	s.waitQueue = nil
+}
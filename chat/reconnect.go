@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// -----------------------------
+// RECONNECT TOKENS
+// -----------------------------
+// reconnectGrace is how long a dropped client's name stays reserved for
+// its reconnect token.
+const reconnectGrace = 2 * time.Minute
+
+// departedClient is what a reconnect token restores.
+type departedClient struct {
+	name    string
+	ignored map[string]bool
+	expires time.Time
+}
+
+// newToken returns a random reconnect token.
+func newToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// holdName keeps cl's name and ignore list for reconnectGrace after its
+// connection dropped. Caller must hold mutex.
+func (s *Server) holdName(cl *client) {
+	s.departed[cl.token] = &departedClient{
+		name:    cl.name,
+		ignored: cl.ignored,
+		expires: time.Now().Add(reconnectGrace),
+	}
+}
+
+// pruneDeparted forgets tokens whose grace period is over. Caller must
+// hold mutex.
+func (s *Server) pruneDeparted() {
+	now := time.Now()
+	for token, d := range s.departed {
+		if now.After(d.expires) {
+			delete(s.departed, token)
+		}
+	}
+}
+
+// nameHeld reports whether a dropped client's name matching skeleton is
+// still reserved. Caller must hold mutex.
+func (s *Server) nameHeld(skeleton string) bool {
+	s.pruneDeparted()
+	for _, d := range s.departed {
+		if nameSkeleton(d.name) == skeleton {
+			return true
+		}
+	}
+	return false
+}
+
+// redeemToken gives cl back the ignore list stored under token and returns
+// the name to rejoin with, or "" if the token is unknown or expired.
+func (s *Server) redeemToken(cl *client, token string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pruneDeparted()
+	d, ok := s.departed[token]
+	if !ok {
+		return ""
+	}
+	delete(s.departed, token)
+	// Claimed right away, like reserveName, until cl joins
+	s.pendingNames[nameSkeleton(d.name)] = cl
+	cl.ignored = d.ignored
+	return d.name
+}
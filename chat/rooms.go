@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// -----------------------------
+// ROOMS
+// -----------------------------
+// defaultRoom is where every client starts.
+const defaultRoom = "general"
+
+var roomRule = fmt.Sprintf("Room name must be 1-%d printable characters, no spaces", maxNameLen)
+
+// Room is a chat channel with its own members and history. Rooms are
+// guarded by the server's mutex.
+type Room struct {
+	name     string
+	members  map[*client]bool
+	messages *messageRing
+	topic    string // set with /topic; "" if none
+}
+
+// getRoom returns the room called name, creating it if needed. Caller must
+// hold mutex.
+func (s *Server) getRoom(name string) *Room {
+	room, ok := s.rooms[name]
+	if !ok {
+		room = &Room{
+			name:     name,
+			members:  make(map[*client]bool),
+			messages: newMessageRing(MaxHistory),
+		}
+		s.rooms[name] = room
+	}
+	return room
+}
+
+// currentRoom returns the room cl is in.
+func (s *Server) currentRoom(cl *client) *Room {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return cl.room
+}
+
+// moveClient moves cl to the room called name (/join) and returns the old
+// and new rooms, which are the same if cl was already there. Both are nil
+// if cl was kicked or disconnected first, so it isn't added back.
+func (s *Server) moveClient(cl *client, name string) (from, to *Room) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.clients[cl] {
+		return nil, nil
+	}
+	from, to = cl.room, s.getRoom(name)
+	if from != to {
+		s.leaveRoom(cl)
+		to.members[cl] = true
+		cl.room = to
+	}
+	return from, to
+}
+
+// leaveRoom removes cl from its room and forgets the room once it is empty
+// (the default room always stays). Caller must hold mutex.
+func (s *Server) leaveRoom(cl *client) {
+	room := cl.room
+	delete(room.members, cl)
+	if len(room.members) == 0 && room.name != defaultRoom {
+		delete(s.rooms, room.name)
+	}
+}
+
+// topicLine renders room's topic for a client arriving there, or "" if it
+// has none. Caller must hold mutex.
+func (s *Server) topicLine(room *Room) string {
+	if room.topic == "" {
+		return ""
+	}
+	return s.colorize(ColorYellow, fmt.Sprintf("Topic of #%s: %s", room.name, room.topic)) + "\n"
+}
+
+// listRooms describes every active room and its member count (/rooms).
+func (s *Server) listRooms() string {
+	s.mutex.Lock()
+	lines := make([]string, 0, len(s.rooms))
+	for name, room := range s.rooms {
+		if len(room.members) == 0 && name != defaultRoom {
+			continue // only known from history, nobody is there
+		}
+		lines = append(lines, fmt.Sprintf("  #%s (%d)", name, len(room.members)))
+	}
+	s.mutex.Unlock()
+
+	sort.Strings(lines)
+	return fmt.Sprintf("Rooms (%d):\n%s\n", len(lines), strings.Join(lines, "\n"))
+}
@@ -0,0 +1,70 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistoryStaysInRoom(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	bob := join(t, s, "bob")
+	alice.expect("bob has joined")
+	alice.send("general only")
+	bob.expect("[alice]:general only")
+
+	bob.send("/join dev")
+	if out := bob.expect("bob has joined #dev"); strings.Contains(out, "general only") {
+		t.Errorf("/join replayed #general into #dev: %q", out)
+	}
+	bob.send("dev only")
+	bob.expect("[bob]:dev only")
+
+	// A new client lands in #general and sees only its history
+	carol := dial(t, s)
+	carol.send("carol")
+	out := carol.expect("You joined as carol")
+	if !strings.Contains(out, "general only") || strings.Contains(out, "dev only") {
+		t.Errorf("join replay in #general = %q", out)
+	}
+
+	carol.send("/join dev")
+	out = carol.expect("carol has joined #dev")
+	if !strings.Contains(out, "dev only") || strings.Contains(out, "general only") {
+		t.Errorf("/join replay in #dev = %q", out)
+	}
+	carol.send("/history")
+	carol.send("/ping done")
+	out = carol.expect("pong done")
+	if !strings.Contains(out, "dev only") || strings.Contains(out, "general only") {
+		t.Errorf("/history in #dev = %q", out)
+	}
+}
+
+func TestMoveClientAfterKick(t *testing.T) {
+	s := startServer(t, nil)
+	alice := join(t, s, "alice")
+	join(t, s, "bob")
+	alice.expect("bob has joined")
+
+	s.mutex.Lock()
+	admin, bob := s.findClient("alice"), s.findClient("bob")
+	admin.isAdmin = true
+	s.mutex.Unlock()
+	s.removeUser(admin, "bob", false)
+
+	// A /join that lost the race to the kick
+	if from, to := s.moveClient(bob, "dev"); from != nil || to != nil {
+		t.Errorf("moveClient of a kicked client = %v, %v; want nil, nil", from, to)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.rooms["dev"]; ok {
+		t.Error("#dev created for a kicked client")
+	}
+	for _, room := range s.rooms {
+		if room.members[bob] {
+			t.Errorf("kicked client still a member of #%s", room.name)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// -----------------------------
+// CONFIG
+// -----------------------------
+// Config holds a Server's settings. Start from DefaultConfig; main fills it
+// in from the command line. NewServer gives fields whose zero value means
+// nothing (MaxClients, MaxPerIP, ConnWindow, NameTimeout, the file paths,
+// TimeFormat, CommandPrefix, NamePrompt and Port) their default, and Start
+// refuses the rest of what no server could run with.
+type Config struct {
+	// Host is the address to bind; empty means all interfaces. Port is the
+	// port to listen on; "0" picks a free one.
+	Host string
+	Port string
+
+	MaxClients int
+	// MaxPerIP limits simultaneous connections from one IP address.
+	MaxPerIP int
+	// MaxLurkers limits receive-only connections.
+	MaxLurkers int
+	// ConnRate limits how many connections one IP may open within
+	// ConnWindow before it is refused for a while; 0 disables the limit.
+	ConnRate   int
+	ConnWindow time.Duration
+
+	// CertFile and KeyFile enable TLS when both are set.
+	CertFile string
+	KeyFile  string
+
+	// LogoPath is the welcome logo file.
+	LogoPath string
+	// MOTDPath is an optional message-of-the-day file shown after the logo.
+	// Escape sequences in it are stripped unless MOTDANSI is set.
+	MOTDPath string
+	MOTDANSI bool
+
+	// Password, when set, must be entered by every client before joining.
+	Password string
+	// AdminPass enables /login for admin commands; empty disables it.
+	AdminPass string
+
+	// HistoryFile stores public messages so history survives a restart.
+	// BanFile stores banned IPs, one per line, so bans do too.
+	HistoryFile string
+	BanFile     string
+
+	// LogFile receives connection events and warnings; empty means stdout.
+	LogFile string
+	// HTTPAddr enables the HTTP status server when set, e.g. ":9090".
+	HTTPAddr string
+
+	// FullWait is how long a connection that finds the server full is held
+	// before admission is retried once; 0 rejects it at once.
+	FullWait time.Duration
+	// QueueSize is how many connections may wait in line for a slot while
+	// the server is full; 0 rejects them.
+	QueueSize int
+	// WriteBatch, when set, makes each client's writer collect lines for up
+	// to this long and send them with one write.
+	WriteBatch time.Duration
+
+	// NameTimeout bounds name entry (and the password prompt), so a client
+	// that connects and never answers doesn't hold a goroutine forever.
+	NameTimeout time.Duration
+
+	// JoinReplay is how many of the room's messages a new client is shown
+	// on join; 0 shows none.
+	JoinReplay int
+	// RejoinQuiet skips the join announcement for a name that left
+	// less than this long ago, treating it as a reconnect; 0 announces
+	// every join.
+	RejoinQuiet time.Duration
+	// MaxSessionMessages disconnects a client after this many public
+	// messages in one session; 0 means no limit.
+	MaxSessionMessages int
+
+	// TimeFormat is the layout for displayed timestamps, rendered in UTC
+	// when UTC is set and in server-local time otherwise.
+	TimeFormat string
+	UTC        bool
+
+	// NoColor disables all ANSI colors in chat output.
+	NoColor bool
+	// Telnet filters telnet negotiation from input and hides the password
+	// from telnet clients while it is typed.
+	Telnet bool
+	// Debug shows each public message's sequence number in chat output.
+	Debug bool
+	// Readline starts every write with ClearLine, so incoming messages
+	// don't run into what the user is typing. Assumes an ANSI terminal.
+	Readline bool
+
+	// CommandPrefix starts a command. A line starting with it twice is sent
+	// as a message beginning with a single prefix.
+	CommandPrefix string
+	// NamePrompt asks for a name after the logo and after every rejected
+	// name.
+	NamePrompt string
+}
+
+// DefaultConfig returns the settings used when no flags are given.
+func DefaultConfig() Config {
+	return Config{
+		Port:          defaultPort,
+		MaxClients:    defaultMaxClients,
+		MaxPerIP:      defaultMaxPerIP,
+		MaxLurkers:    defaultMaxLurkers,
+		ConnRate:      defaultConnRate,
+		ConnWindow:    defaultConnWindow,
+		LogoPath:      defaultLogoPath,
+		HistoryFile:   defaultHistoryFile,
+		BanFile:       defaultBanFile,
+		NameTimeout:   defaultNameTimeout,
+		JoinReplay:    MaxHistory,
+		RejoinQuiet:   defaultRejoinQuiet,
+		TimeFormat:    defaultTimeFormat,
+		CommandPrefix: "/",
+		NamePrompt:    defaultNamePrompt,
+	}
+}
+
+// withDefaults returns c with the zero fields that have no meaning of their
+// own set from DefaultConfig. Zeros that mean "off" or "none" are kept.
+func (c Config) withDefaults() Config {
+	def := DefaultConfig()
+	for _, f := range []struct {
+		v   *string
+		def string
+	}{
+		{&c.Port, def.Port},
+		{&c.LogoPath, def.LogoPath},
+		{&c.HistoryFile, def.HistoryFile},
+		{&c.BanFile, def.BanFile},
+		{&c.TimeFormat, def.TimeFormat},
+		{&c.CommandPrefix, def.CommandPrefix},
+		{&c.NamePrompt, def.NamePrompt},
+	} {
+		if *f.v == "" {
+			*f.v = f.def
+		}
+	}
+	if c.MaxClients == 0 {
+		c.MaxClients = def.MaxClients
+	}
+	if c.MaxPerIP == 0 {
+		c.MaxPerIP = def.MaxPerIP
+	}
+	if c.ConnWindow == 0 {
+		c.ConnWindow = def.ConnWindow
+	}
+	if c.NameTimeout == 0 {
+		c.NameTimeout = def.NameTimeout
+	}
+	return c
+}
+
+// validate reports the first setting a server can't run with.
+func (c Config) validate() error {
+	if n, err := strconv.Atoi(c.Port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid Port %q, must be a number from 0 to 65535", c.Port)
+	}
+	for _, f := range []struct {
+		name  string
+		value int64
+	}{
+		{"MaxClients", int64(c.MaxClients)},
+		{"MaxPerIP", int64(c.MaxPerIP)},
+		{"ConnWindow", int64(c.ConnWindow)},
+		{"NameTimeout", int64(c.NameTimeout)},
+	} {
+		if f.value <= 0 {
+			return fmt.Errorf("%s must be positive", f.name)
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value int64
+	}{
+		{"MaxLurkers", int64(c.MaxLurkers)},
+		{"ConnRate", int64(c.ConnRate)},
+		{"FullWait", int64(c.FullWait)},
+		{"QueueSize", int64(c.QueueSize)},
+		{"WriteBatch", int64(c.WriteBatch)},
+		{"RejoinQuiet", int64(c.RejoinQuiet)},
+		{"MaxSessionMessages", int64(c.MaxSessionMessages)},
+	} {
+		if f.value < 0 {
+			return fmt.Errorf("%s must not be negative", f.name)
+		}
+	}
+	if c.JoinReplay < 0 || c.JoinReplay > MaxHistory {
+		return fmt.Errorf("JoinReplay must be between 0 and %d", MaxHistory)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("CertFile and KeyFile must be set together")
+	}
+	// A layout without any time elements formats to itself. The sample
+	// differs from the reference time in every field.
+	sample := time.Date(2001, 11, 12, 3, 9, 7, 0, time.UTC)
+	if sample.Format(c.TimeFormat) == c.TimeFormat {
+		return fmt.Errorf("invalid TimeFormat %q, expected a Go layout such as %q", c.TimeFormat, defaultTimeFormat)
+	}
+	if strings.ContainsFunc(c.CommandPrefix, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r) || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) {
+		return fmt.Errorf("invalid CommandPrefix %q, must be punctuation such as / or !", c.CommandPrefix)
+	}
+	if strings.ContainsFunc(c.NamePrompt, unicode.IsControl) {
+		return fmt.Errorf("invalid NamePrompt %q, must be printable text", c.NamePrompt)
+	}
+	return nil
+}
+
+// -----------------------------
+// SERVER
+// -----------------------------
+// Server is one chat server. All of its shared state is guarded by mutex;
+// helpers that expect it held say "Caller must hold mutex".
+type Server struct {
+	cfg Config
+
+	mutex      sync.Mutex
+	clients    map[*client]bool // every joined client, in any room
+	connsPerIP map[string]int   // open connections, joined, naming or queued
+	rooms      map[string]*Room // every known room by name
+	lurkers    map[*client]bool // receive-only clients, members of a room but never in clients
+	banned     map[string]bool  // banned IPs, mirrored in BanFile
+
+	// pendingNames holds names chosen at the prompt by clients that haven't
+	// joined yet (e.g. still entering the password), keyed by nameSkeleton.
+	pendingNames map[string]*client
+	departed     map[string]*departedClient // dropped clients by reconnect token
+	departures   []departure                // latest leaves, oldest first, from every room (/recent)
+	waitQueue    []*waiter                  // connections waiting for a slot, oldest first
+	recentLeaves map[string]time.Time       // leave times by nameSkeleton, within RejoinQuiet
+
+	// connAttempts tracks recent connections per IP for -connrate
+	connAttempts  map[string]*connAttempts
+	lastConnPrune time.Time
+
+	// draining makes admit turn new connections away (/drain)
+	draining bool
+
+	historyLog *os.File
+	eventLog   *log.Logger
+
+	// logo and motd are read once at startup
+	logo string
+	motd string
+
+	// Server metrics for /stats and /metrics
+	startTime        time.Time
+	totalMessages    int
+	totalConnections int
+	rejectedFull     int
+	lastSeq          uint64 // sequence number of the latest public message
+
+	listener net.Listener
+	http     *http.Server // the -http status server, if any
+
+	// conns is the context handed to every connection; Stop cancels it once
+	// the shutdown notices are flushed, closing whatever is still open.
+	conns       context.Context
+	cancelConns context.CancelFunc
+	handlers    sync.WaitGroup // admit and handleConnection goroutines
+	accepted    chan struct{}  // closed when acceptLoop returns, so no more handlers.Add
+	stopOnce    sync.Once
+	stopped     chan struct{} // closed once every connection has finished
+}
+
+// NewServer returns a server for cfg, with unset fields defaulted.
+// Nothing is opened until Start.
+func NewServer(cfg Config) *Server {
+	return &Server{
+		cfg:          cfg.withDefaults(),
+		clients:      make(map[*client]bool),
+		connsPerIP:   make(map[string]int),
+		rooms:        make(map[string]*Room),
+		lurkers:      make(map[*client]bool),
+		banned:       make(map[string]bool),
+		pendingNames: make(map[string]*client),
+		departed:     make(map[string]*departedClient),
+		connAttempts: make(map[string]*connAttempts),
+		recentLeaves: make(map[string]time.Time),
+		eventLog:     log.New(os.Stdout, "", log.LstdFlags),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// -----------------------------
+// SERVER START
+// -----------------------------
+// Start checks the configuration, loads history and bans, starts listening
+// and accepts connections in the background until Stop or until ctx is
+// canceled.
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.cfg.validate(); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	if err := s.loadHistory(); err != nil {
+		return err
+	}
+	if err := s.loadBans(); err != nil {
+		s.closeHistory()
+		return err
+	}
+	if err := s.openEventLog(); err != nil {
+		s.closeHistory()
+		return err
+	}
+	s.startTime = time.Now()
+	s.logo = s.loadLogo(s.cfg.LogoPath)
+	s.motd = s.loadMOTD(s.cfg.MOTDPath)
+
+	addr := net.JoinHostPort(s.cfg.Host, s.cfg.Port)
+	listener, err := s.listen(addr)
+	if err != nil {
+		s.closeHistory()
+		return err
+	}
+	// The bound address, not the requested one, so port 0 shows the real port
+	s.eventLog.Printf("Listening on %s", listener.Addr())
+
+	if s.cfg.HTTPAddr != "" {
+		if err := s.startHTTP(s.cfg.HTTPAddr); err != nil {
+			listener.Close()
+			s.closeHistory()
+			return fmt.Errorf("cannot start HTTP server: %v", err)
+		}
+	}
+
+	s.listener = listener
+	// Connections keep ctx's values but not its cancellation, so a canceled
+	// ctx still lets Stop tell everyone goodbye before their conns close
+	s.conns, s.cancelConns = context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.stopped:
+		}
+	}()
+	s.accepted = make(chan struct{})
+	go s.acceptLoop()
+	return nil
+}
+
+// Addr returns the address the server is listening on, once started.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Wait blocks until the server has stopped.
+func (s *Server) Wait() {
+	<-s.stopped
+}
+
+func (s *Server) acceptLoop() {
+	defer close(s.accepted)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // only Stop closes the listener
+			}
+			s.eventLog.Printf("Error: %v", err)
+			continue
+		}
+		if !s.allowConnect(conn.RemoteAddr(), time.Now()) {
+			conn.Close()
+			continue
+		}
+
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.admit(s.conns, conn)
+		}()
+	}
+}
+
+// admit applies bans and connection limits to a new connection and hands
+// it to handleConnection if it may stay. It runs on its own goroutine so
+// waiting for a free slot (-fullwait) doesn't hold up the accept loop.
+// Canceling ctx closes conn.
+func (s *Server) admit(ctx context.Context, conn net.Conn) {
+	// Nothing below may block past Stop, even before handleConnection
+	// takes over closing conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Otherwise the first write would run the handshake with no
+		// deadline, and a peer that never sends a ClientHello would hold
+		// this goroutine
+		tlsConn.SetDeadline(time.Now().Add(writeTimeout))
+		err := tlsConn.HandshakeContext(ctx)
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			s.logEvent("TLS", "%s handshake failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	// Banned IPs are refused before they ever see the name prompt
+	if s.isBanned(conn.RemoteAddr().String()) {
+		s.logEvent("BANNED", "%s refused", conn.RemoteAddr())
+		writeNotice(conn, "You are banned\n")
+		conn.Close()
+		return
+	}
+
+	s.mutex.Lock()
+	s.totalConnections++
+	if s.draining {
+		s.mutex.Unlock()
+		s.logEvent("DRAIN", "%s refused, server is draining", conn.RemoteAddr())
+		writeNotice(conn, "The server is about to restart. Try again in a minute.\n")
+		conn.Close()
+		return
+	}
+	// The per-IP slot is taken before any waiting, so one address can't
+	// fill the queue
+	ip := hostOf(conn.RemoteAddr().String())
+	if s.connsPerIP[ip] >= s.cfg.MaxPerIP {
+		s.mutex.Unlock()
+		s.logEvent("PERIP", "%s rejected, too many connections", conn.RemoteAddr())
+		writeNotice(conn, fmt.Sprintf("Too many connections from your address (max %d).\n", s.cfg.MaxPerIP))
+		conn.Close()
+		return
+	}
+	s.connsPerIP[ip]++
+	defer s.releaseIP(ip)
+	if len(s.clients) >= s.cfg.MaxClients && s.cfg.FullWait > 0 {
+		s.mutex.Unlock()
+		writeNotice(conn, fmt.Sprintf("Server full (%d/%d). Waiting %s for a free slot...\n", s.cfg.MaxClients, s.cfg.MaxClients, s.cfg.FullWait))
+		select {
+		case <-time.After(s.cfg.FullWait):
+		case <-ctx.Done():
+			conn.Close()
+			return
+		}
+		s.mutex.Lock()
+	}
+	// Once anyone is queued, newcomers line up behind them
+	if n := len(s.clients); n >= s.cfg.MaxClients || len(s.waitQueue) > 0 {
+		w := s.enqueue(conn)
+		if w == nil {
+			s.rejectedFull++
+			s.mutex.Unlock()
+			s.logEvent("FULL", "%s rejected, server full (%d/%d)", conn.RemoteAddr(), n, s.cfg.MaxClients)
+			writeNotice(conn, fmt.Sprintf("Server full (%d/%d). Try again later.\n", n, s.cfg.MaxClients))
+			conn.Close()
+			return
+		}
+		position := len(s.waitQueue)
+		s.mutex.Unlock()
+		s.logEvent("QUEUE", "%s queued at position %d", conn.RemoteAddr(), position)
+		if !s.waitForSlot(w, position) {
+			return
+		}
+		s.mutex.Lock()
+		if s.draining {
+			s.mutex.Unlock()
+			writeNotice(conn, "The server is about to restart. Try again in a minute.\n")
+			conn.Close()
+			return
+		}
+	}
+	s.mutex.Unlock()
+
+	s.logEvent("CONNECT", "%s", conn.RemoteAddr())
+	enableKeepAlive(conn)
+	s.handleConnection(ctx, conn)
+}
+
+// writeNotice writes text to a connection that has no client writer yet,
+// bounded by writeTimeout so a peer that stops reading can't block us.
+func writeNotice(conn net.Conn, text string) {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.Write([]byte(text))
+	conn.SetWriteDeadline(time.Time{})
+}
+
+// -----------------------------
+// LISTEN (plain TCP or TLS)
+// -----------------------------
+// listen opens a TLS listener when a certificate is configured and a plain
+// TCP one otherwise. A certificate that fails to load is an error: we never
+// fall back to plaintext.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if s.cfg.CertFile == "" {
+		listener, err = net.Listen("tcp", addr)
+	} else {
+		cert, certErr := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+		if certErr != nil {
+			return nil, fmt.Errorf("cannot load TLS certificate: %v", certErr)
+		}
+		listener, err = tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %v", addr, err)
+	}
+	return listener, nil
+}
+
+// -----------------------------
+// SHUTDOWN
+// -----------------------------
+// Stop disconnects everyone, closes the listeners and the history file, and
+// returns once every connection's goroutine has finished. Only the first
+// call (canceled context, /shutdown or the embedding program) does anything.
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		s.shutdownNow()
+		// Connections still at the prompt or in the queue go now too
+		if s.cancelConns != nil {
+			s.cancelConns()
+		}
+		// The closed listener ends acceptLoop; only after it returns can
+		// handlers.Wait not race a handlers.Add
+		if s.accepted != nil {
+			<-s.accepted
+		}
+		s.handlers.Wait()
+		s.closeHistory()
+		close(s.stopped)
+	})
+}
+
+func (s *Server) shutdownNow() {
+	s.eventLog.Print("Shutting down...")
+	s.mutex.Lock()
+	closing := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		closing = append(closing, c)
+	}
+	for c := range s.lurkers {
+		closing = append(closing, c)
+	}
+	for _, c := range closing {
+		c.send(s.colorize(ColorYellow, "Server is shutting down") + "\n")
+		c.close()
+	}
+	s.closeWaiters()
+	s.mutex.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+
+	// Let the writers flush the notice before the process exits
+	for _, c := range closing {
+		<-c.done
+	}
+}
@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxPerIP(t *testing.T) {
+	s := startServer(t, func(cfg *Config) { cfg.MaxPerIP = 2 })
+	first := join(t, s, "alice")
+	second := dial(t, s) // counted while still at the name prompt
+	second.expect(s.cfg.NamePrompt)
+
+	third := dial(t, s)
+	third.expect("Too many connections from your address (max 2)")
+	third.expectClosed()
+
+	first.send("/quit")
+	first.expectClosed()
+	// The slot is released once the session has finished
+	deadline := time.Now().Add(testTimeout)
+	for {
+		c := dial(t, s)
+		c.read(time.Now().Add(200 * time.Millisecond))
+		if c.buf != "" && !strings.Contains(c.buf, "Too many connections") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection still refused after one closed: %q", c.buf)
+		}
+	}
+}
+
+func TestCancelStopsServer(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := startServerContext(t, ctx, func(cfg *Config) {
+		cfg.MaxClients, cfg.QueueSize = 1, 1
+	})
+	naming := dial(t, s)
+	naming.expect(s.cfg.NamePrompt)
+	alice := join(t, s, "alice")
+	queued := dial(t, s)
+	queued.expect("You are number 1 in line")
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(testTimeout):
+		t.Fatal("Wait still blocked after the context was canceled")
+	}
+
+	alice.expect("Server is shutting down")
+	alice.expectClosed()
+	queued.expect("Server is shutting down")
+	queued.expectClosed()
+	naming.expectClosed()
+	if c, err := net.DialTimeout("tcp", s.Addr().String(), time.Second); err == nil {
+		c.Close()
+		t.Error("still accepting connections")
+	}
+
+	// Every handler, writer and watcher has returned
+	deadline := time.Now().Add(testTimeout)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left, started with %d:\n%s",
+				runtime.NumGoroutine(), goroutines, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir and returns their paths.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestStopWithSilentTLSPeers(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	s := startServer(t, func(cfg *Config) {
+		cfg.CertFile, cfg.KeyFile = certFile, keyFile
+		cfg.MaxPerIP = 1
+	})
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &testClient{t: t, conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	alice.send("alice")
+	alice.expect("You joined as alice")
+
+	// Over the per-IP limit, and never sends a ClientHello
+	silent, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(testTimeout):
+		t.Fatal("Stop blocked by a connection that never finished the TLS handshake")
+	}
+	alice.expect("Server is shutting down")
+}
+
+func TestZeroConfigDefaults(t *testing.T) {
+	// The default history, ban and logo files are relative to the
+	// working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	s := NewServer(Config{Port: "0", LogFile: "events.log"})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	c := dial(t, s)
+	c.expect(defaultNamePrompt)
+	c.send("bob")
+	c.expect("You joined as bob")
+	c.send("/ping x")
+	c.expect("pong x")
+	c.send("hello")
+	c.expect("[" + time.Now().Format("2006-01-02"))
+	c.expect("[bob]:hello")
+
+	for _, cfg := range []Config{
+		{Port: "0", MaxPerIP: -1},
+		{Port: "0", NameTimeout: -time.Second},
+		{Port: "0", ConnRate: -1},
+		{Port: "0", JoinReplay: MaxHistory + 1},
+		{Port: "0", CertFile: "cert.pem"},
+		{Port: "0", TimeFormat: "no digits"},
+		{Port: "0", CommandPrefix: "x"},
+		{Port: "0", NamePrompt: "name\x1b[2J"},
+		{Port: "http"},
+	} {
+		s := NewServer(cfg)
+		if err := s.Start(context.Background()); err == nil {
+			s.Stop()
+			t.Errorf("Start(%+v) succeeded, want an invalid config error", cfg)
+		}
+	}
+}
+
+func TestStopWhileAccepting(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s := startServer(t, func(cfg *Config) { cfg.ConnRate = 0 })
+		addr := s.Addr().String()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					return // listener closed
+				}
+				c.Close()
+			}
+		}()
+		time.Sleep(time.Millisecond)
+		s.Stop()
+		<-done
+	}
+}
+
+func TestQueuedConnectionsCountPerIP(t *testing.T) {
+	s := startServer(t, func(cfg *Config) {
+		cfg.MaxClients, cfg.QueueSize, cfg.MaxPerIP = 1, 3, 2
+	})
+	join(t, s, "alice")
+	queued := dial(t, s)
+	queued.expect("You are number 1 in line")
+
+	over := dial(t, s)
+	over.expect("Too many connections from your address (max 2)")
+	over.expectClosed()
+
+	// Leaving the queue gives the slot back
+	queued.conn.Close()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		c := dial(t, s)
+		c.read(time.Now().Add(200 * time.Millisecond))
+		if strings.Contains(c.buf, "You are number 1 in line") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still refused after the queued connection left: %q", c.buf)
+		}
+		c.conn.Close()
+	}
+}
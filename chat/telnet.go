@@ -0,0 +1,91 @@
+package chat
+
+import "io"
+
+// -----------------------------
+// TELNET SUPPORT (-telnet)
+// -----------------------------
+// Telnet protocol bytes (RFC 854, RFC 857).
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+	telnetEcho = 1
+)
+
+// Sent around password entry: while the server "will echo" (and doesn't),
+// compliant clients stop echoing locally, so the password stays hidden.
+// Nothing else is negotiated from the start of the connection, since the
+// server reads whole lines and would have to echo names keystroke by
+// keystroke; the name prompt keeps the client's own echo.
+var (
+	telnetEchoOff = string([]byte{telnetIAC, telnetWILL, telnetEcho})
+	telnetEchoOn  = string([]byte{telnetIAC, telnetWONT, telnetEcho})
+)
+
+// telnetReader strips telnet commands and option negotiation from a
+// client's input so they never end up in names or messages.
+type telnetReader struct {
+	r     io.Reader
+	state int
+}
+
+// telnetReader states
+const (
+	tnData   = iota
+	tnIAC    // after IAC
+	tnOption // after IAC WILL/WONT/DO/DONT, expecting the option byte
+	tnSub    // inside IAC SB ... IAC SE
+	tnSubIAC // IAC seen inside a subnegotiation
+)
+
+func (t *telnetReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.r.Read(p)
+		out := 0
+		for _, b := range p[:n] {
+			switch t.state {
+			case tnData:
+				if b == telnetIAC {
+					t.state = tnIAC
+					continue
+				}
+				p[out] = b
+				out++
+			case tnIAC:
+				switch b {
+				case telnetIAC: // escaped 0xFF data byte
+					p[out] = b
+					out++
+					t.state = tnData
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+					t.state = tnOption
+				case telnetSB:
+					t.state = tnSub
+				default: // two-byte command such as NOP or GA
+					t.state = tnData
+				}
+			case tnOption:
+				t.state = tnData
+			case tnSub:
+				if b == telnetIAC {
+					t.state = tnSubIAC
+				}
+			case tnSubIAC:
+				if b == telnetSE {
+					t.state = tnData
+				} else {
+					t.state = tnSub
+				}
+			}
+		}
+		// Don't report a zero-byte read for a chunk that was all commands
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
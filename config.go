@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// -----------------------------
+// CONFIG FILE (-config)
+// -----------------------------
+// A config file holds one "key = value" setting per line; blank lines and
+// lines starting with # are ignored. Keys are flag names without the dash
+// (max, host, logo, motd, ...) plus port. Flags given on the command line
+// win over the file.
+
+// configAliases maps alternative key spellings to flag names.
+var configAliases = map[string]string{
+	"maxclients": "max",
+}
+
+// readConfig parses the config file at path into key/value pairs. Keys are
+// lower-cased and aliases resolved.
+func readConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if alias, ok := configAliases[key]; ok {
+			key = alias
+		}
+		if _, dup := settings[key]; dup {
+			return nil, fmt.Errorf("line %d: %s set twice", n, key)
+		}
+		settings[key] = strings.TrimSpace(value)
+	}
+	return settings, scanner.Err()
+}
+
+// applyConfig loads path and sets every flag the command line left alone.
+// It returns the configured port, or "" if the file has none.
+func applyConfig(path string) (string, error) {
+	settings, err := readConfig(path)
+	if err != nil {
+		return "", err
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	port := settings["port"]
+	delete(settings, "port")
+	for key, value := range settings {
+		if key == "config" || key == "v" || flag.Lookup(key) == nil {
+			return "", fmt.Errorf("unknown setting %q", key)
+		}
+		if given[key] {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return "", fmt.Errorf("bad value for %s: %v", key, err)
+		}
+	}
+	return port, nil
+}
@@ -0,0 +1,3 @@
+module github.com/SIM0N0URI/NETCAT-v1.0
+
+go 1.22
@@ -0,0 +1,150 @@
+// Command loadtest measures broadcast throughput and latency of a running
+// TCPChat server. It joins -clients fake users, has each of them send
+// -messages chat lines and reports how long the server took to deliver
+// every line to every member of the room.
+//
+// Start the server with limits that fit the test, for example:
+//
+//	./TCPChat -max 100 -maxperip 100 -connrate 0 9000
+//	go run loadtest/main.go -addr localhost:9000 -clients 50 -messages 5
+//
+// The server rate-limits each client to 5 lines per 2 seconds, so keep
+// -interval at 400ms or more when -messages is above 5.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8989", "server address")
+	numClients := flag.Int("clients", 20, "number of clients to connect")
+	numMessages := flag.Int("messages", 5, "messages each client sends")
+	interval := flag.Duration("interval", 0, "pause between a client's messages")
+	timeout := flag.Duration("timeout", 30*time.Second, "give up waiting for deliveries after this long")
+	flag.Parse()
+
+	if *numClients < 1 || *numMessages < 1 {
+		fmt.Println("Error: -clients and -messages must be positive")
+		os.Exit(1)
+	}
+
+	// Tags lines so replayed history from earlier runs isn't counted
+	run := strconv.Itoa(rand.Intn(1e6))
+	marker := "LT|" + run + "|"
+	latencies := make(chan time.Duration, 1024)
+
+	conns := make([]net.Conn, *numClients)
+	for i := range conns {
+		conn, err := join(*addr, fmt.Sprintf("lt%s_%d", run, i), marker, latencies)
+		if err != nil {
+			fmt.Printf("Error: client %d: %v\n", i, err)
+			os.Exit(1)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	fmt.Printf("%d clients joined, sending %d messages each\n", *numClients, *numMessages)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			for j := 0; j < *numMessages; j++ {
+				fmt.Fprintf(conn, "%s%d\n", marker, time.Now().UnixNano())
+				time.Sleep(*interval)
+			}
+		}(conn)
+	}
+
+	// Every member, the sender included, receives every message
+	expected := *numClients * *numClients * *numMessages
+	received := make([]time.Duration, 0, expected)
+	deadline := time.After(*timeout)
+wait:
+	for len(received) < expected {
+		select {
+		case d := <-latencies:
+			received = append(received, d)
+		case <-deadline:
+			break wait
+		}
+	}
+	elapsed := time.Since(start)
+	wg.Wait()
+
+	report(received, expected, elapsed)
+}
+
+// join connects, enters name and waits for the join confirmation. A reader
+// goroutine then reports the latency of every line carrying marker.
+func join(addr, name, marker string, latencies chan<- time.Duration) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(conn, name)
+
+	scanner := bufio.NewScanner(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if !scanner.Scan() {
+			conn.Close()
+			if scanner.Err() != nil {
+				return nil, scanner.Err()
+			}
+			return nil, fmt.Errorf("disconnected before joining")
+		}
+		if strings.Contains(scanner.Text(), "You joined as") {
+			break
+		}
+		if strings.Contains(scanner.Text(), "Server full") || strings.Contains(scanner.Text(), "Too many connections") {
+			conn.Close()
+			return nil, fmt.Errorf("%s", scanner.Text())
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go func() {
+		for scanner.Scan() {
+			line := scanner.Text()
+			i := strings.Index(line, marker)
+			if i < 0 {
+				continue
+			}
+			// Drop the color reset that follows the timestamp
+			field := strings.TrimSuffix(line[i+len(marker):], "\x1b[0m")
+			sent, err := strconv.ParseInt(field, 10, 64)
+			if err == nil {
+				latencies <- time.Since(time.Unix(0, sent))
+			}
+		}
+	}()
+	return conn, nil
+}
+
+func report(received []time.Duration, expected int, elapsed time.Duration) {
+	fmt.Printf("Delivered %d/%d lines in %s (%.0f lines/s)\n",
+		len(received), expected, elapsed.Round(time.Millisecond),
+		float64(len(received))/elapsed.Seconds())
+	if len(received) == 0 {
+		return
+	}
+	sort.Slice(received, func(i, j int) bool { return received[i] < received[j] })
+	pct := func(p float64) time.Duration {
+		return received[int(p*float64(len(received)-1))].Round(time.Microsecond)
+	}
+	fmt.Printf("Latency p50 %s, p90 %s, p99 %s, max %s\n", pct(0.50), pct(0.90), pct(0.99), pct(1))
+}
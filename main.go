@@ -1,227 +1,234 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-)
-
-// -----------------------------
-// CONFIGURATION
-// -----------------------------
-const defaultPort = "8989"
+	"unicode"
 
-var maxClients = 10
-
-// -----------------------------
-// GLOBALS
-// -----------------------------
-var (
-	clients  = make(map[net.Conn]string)
-	messages []string
-	mutex    sync.Mutex
+	"github.com/SIM0N0URI/NETCAT-v1.0/chat"
 )
 
-// -----------------------------
-// ANSI COLOR CODES
-// -----------------------------
-const (
-	ColorReset  = "\033[0m"
-	ColorRed    = "\033[31m"
-	ColorGreen  = "\033[32m"
-	ColorYellow = "\033[33m"
-	ColorBlue   = "\033[34m"
-)
+// version is reported by -v; release builds override it with
+// -ldflags "-X main.version=..."
+var version = "1.0.0"
+
+const usage = "[USAGE]: ./TCPChat [flags] $port (-h lists flags)"
 
 // -----------------------------
 // MAIN
 // -----------------------------
 func main() {
-	port := parsePortArg()
-	startServer(port)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := chat.NewServer(parseArgs())
+	if err := srv.Start(ctx); err != nil {
+		fatal("%v", err)
+	}
+	srv.Wait()
 }
 
 // -----------------------------
 // PARSE ARGUMENTS
 // -----------------------------
-func parsePortArg() string {
-	if len(os.Args) > 2 {
-		fmt.Println("[USAGE]: ./TCPChat $port")
-		os.Exit(0)
+// parseArgs builds the server configuration from the command line and an
+// optional -config file, exiting on bad input.
+func parseArgs() chat.Config {
+	// -v/--version wins over everything else on the command line
+	for _, arg := range os.Args[1:] {
+		if arg == "--" {
+			break
+		}
+		if arg == "-v" || arg == "--version" || arg == "-version" {
+			fmt.Printf("TCPChat %s (%s)\n", version, runtime.Version())
+			os.Exit(0)
+		}
 	}
 
-	port := defaultPort
-	if len(os.Args) == 2 {
-		port = os.Args[1]
+	def := chat.DefaultConfig()
+	flag.Usage = func() {
+		fmt.Println(usage)
+		flag.PrintDefaults()
 	}
-	return port
-}
-
-// -----------------------------
-// SERVER START
-// -----------------------------
-func startServer(port string) {
-	listener, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		fmt.Println("Error:", err)
-		return
+	max := flag.Int("max", def.MaxClients, "maximum number of connected clients")
+	perIP := flag.Int("maxperip", def.MaxPerIP, "maximum simultaneous connections per IP")
+	connRate := flag.Int("connrate", def.ConnRate, "connections one IP may open per -connwindow before being refused for a while (0 = unlimited)")
+	connWindow := flag.Duration("connwindow", def.ConnWindow, "window for -connrate")
+	maxLurk := flag.Int("maxlurkers", def.MaxLurkers, "maximum receive-only clients (name \"-\")")
+	host := flag.String("host", "", "address to listen on (default all interfaces)")
+	cert := flag.String("cert", "", "TLS certificate file")
+	key := flag.String("key", "", "TLS private key file")
+	logoFile := flag.String("logo", def.LogoPath, "welcome logo file")
+	motdFile := flag.String("motd", "", "message of the day file")
+	motdEsc := flag.Bool("motdansi", false, "allow ANSI escape sequences in the MOTD")
+	pass := flag.String("password", "", "shared password required to join")
+	admin := flag.String("adminpass", "", "password for /login to admin commands")
+	logPath := flag.String("logfile", "", "file for connection events (default stdout)")
+	httpListen := flag.String("http", "", "address for the HTTP status server, e.g. :9090")
+	wait := flag.Duration("fullwait", 0, "hold connections to a full server this long and retry once, e.g. 5s")
+	queue := flag.Int("queue", 0, "connections to hold in line, oldest first, while the server is full")
+	batch := flag.Duration("batch", 0, "coalesce output written within this window, e.g. 50ms")
+	timeLayout := flag.String("timeformat", def.TimeFormat, "Go time layout for timestamps")
+	utc := flag.Bool("utc", false, "show timestamps in UTC")
+	plain := flag.Bool("nocolor", false, "disable ANSI colors")
+	telnet := flag.Bool("telnet", false, "speak telnet option negotiation")
+	debug := flag.Bool("debug", false, "show message sequence numbers")
+	prefix := flag.String("prefix", def.CommandPrefix, "string that starts a chat command")
+	prompt := flag.String("prompt", def.NamePrompt, "text asking for a name")
+	maxMsgs := flag.Int("maxmessages", 0, "disconnect a client after this many messages in one session (0 = unlimited)")
+	rejoinQuiet := flag.Duration("rejoinquiet", def.RejoinQuiet, "don't announce a name rejoining within this long of leaving (0 = always announce)")
+	replayLines := flag.Int("replay", chat.MaxHistory, "messages of history shown to a client on join")
+	readline := flag.Bool("readline", false, "clear the input line before each incoming message (ANSI terminals)")
+	configFile := flag.String("config", "", "file of key = value settings; flags override it")
+	flag.Bool("v", false, "print the version and exit")
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usageError("too many arguments")
 	}
-	defer listener.Close()
-	fmt.Println("Listening on the port :" + port)
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("Error:", err)
-			continue
-		}
-
-		mutex.Lock()
-		if len(clients) >= maxClients {
-			conn.Write([]byte("Server full. Try again later.\n"))
-			conn.Close()
-			mutex.Unlock()
-			continue
+	cfg := def
+	configPort := ""
+	if *configFile != "" {
+		var err error
+		if configPort, err = applyConfig(*configFile); err != nil {
+			usageError("config %s: %v", *configFile, err)
 		}
-		mutex.Unlock()
-
-		go handleConnection(conn)
 	}
-}
-
-// -----------------------------
-// HANDLE CLIENT CONNECTION
-// -----------------------------
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-
-	// Send logo
-	conn.Write([]byte(loadLogo()))
-
-	// Get client name
-	name := getClientName(conn)
-	if name == "" {
-		return
+	if *max <= 0 {
+		usageError("-max must be a positive number")
 	}
+	cfg.MaxClients = *max
 
-	// Add client and send old messages in red
-	mutex.Lock()
-	clients[conn] = name
-	for _, msg := range messages {
-		conn.Write([]byte(ColorRed + msg + ColorReset + "\n"))
+	if *perIP <= 0 {
+		usageError("-maxperip must be a positive number")
 	}
-	mutex.Unlock()
+	cfg.MaxPerIP = *perIP
 
-	// Announce join (yellow) to others only
-	announce(fmt.Sprintf("%s has joined our chat...", name), conn)
+	if *connRate < 0 {
+		usageError("-connrate must not be negative")
+	}
+	if *connWindow <= 0 {
+		usageError("-connwindow must be a positive duration")
+	}
+	cfg.ConnRate, cfg.ConnWindow = *connRate, *connWindow
 
-	// Listen for messages
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		text := strings.TrimSpace(scanner.Text())
-		if text == "" {
-			continue
-		}
-		msg := formatMessage(name, text)
-		mutex.Lock()
-		messages = append(messages, msg)
-		mutex.Unlock()
-		broadcast(msg, conn)
-	}
-
-	// Client disconnect
-	mutex.Lock()
-	delete(clients, conn)
-	mutex.Unlock()
-	announce(fmt.Sprintf("%s has left our chat...", name), nil)
-}
+	if *maxLurk < 0 {
+		usageError("-maxlurkers must not be negative")
+	}
+	cfg.MaxLurkers = *maxLurk
 
-// -----------------------------
-// LOAD LOGO
-// -----------------------------
-func loadLogo() string {
-	data, err := os.ReadFile("linuxlogo.txt")
+	h, err := listenHost(*host)
 	if err != nil {
-		return "Welcome to TCP-Chat!\n[ENTER YOUR NAME]: "
+		usageError("invalid -host: %v", err)
 	}
-	return string(data) + "\n"
-}
+	cfg.Host = h
 
-// -----------------------------
-// GET CLIENT NAME (unique)
-// -----------------------------
-func getClientName(conn net.Conn) string {
-	scanner := bufio.NewScanner(conn)
-	conn.Write([]byte("\n[ENTER YOUR NAME]: "))
-	for {
-		if !scanner.Scan() {
-			return ""
-		}
-		name := strings.TrimSpace(scanner.Text())
-		if name == "" {
-			conn.Write([]byte("\n[ENTER YOUR NAME]: "))
-			continue
-		}
+	if (*cert == "") != (*key == "") {
+		usageError("-cert and -key must be used together")
+	}
+	cfg.CertFile, cfg.KeyFile = *cert, *key
+	cfg.LogoPath = *logoFile
+	cfg.MOTDPath, cfg.MOTDANSI = *motdFile, *motdEsc
+	cfg.Password = *pass
+	cfg.AdminPass = *admin
+	cfg.LogFile = *logPath
+	cfg.HTTPAddr = *httpListen
+	if *wait < 0 {
+		usageError("-fullwait must not be negative")
+	}
+	cfg.FullWait = *wait
+	if *queue < 0 {
+		usageError("-queue must not be negative")
+	}
+	cfg.QueueSize = *queue
+	if *batch < 0 || *batch > time.Second {
+		usageError("-batch must be between 0 and 1s")
+	}
+	cfg.WriteBatch = *batch
+	if *replayLines < 0 || *replayLines > chat.MaxHistory {
+		usageError("-replay must be between 0 and %d", chat.MaxHistory)
+	}
+	cfg.JoinReplay = *replayLines
+	if *rejoinQuiet < 0 {
+		usageError("-rejoinquiet must not be negative")
+	}
+	cfg.RejoinQuiet = *rejoinQuiet
+	if *maxMsgs < 0 {
+		usageError("-maxmessages must not be negative")
+	}
+	cfg.MaxSessionMessages = *maxMsgs
 
-		mutex.Lock()
-		nameTaken := false
-		for _, n := range clients {
-			if n == name {
-				nameTaken = true
-				break
-			}
-		}
-		mutex.Unlock()
+	// A layout without any time elements formats to itself. The sample
+	// differs from the reference time in every field.
+	sample := time.Date(2001, 11, 12, 3, 9, 7, 0, time.UTC)
+	if *timeLayout == "" || sample.Format(*timeLayout) == *timeLayout {
+		usageError("invalid -timeformat %q, expected a Go layout such as %q", *timeLayout, def.TimeFormat)
+	}
+	cfg.TimeFormat, cfg.UTC = *timeLayout, *utc
+	cfg.NoColor = *plain
+	cfg.Telnet = *telnet
+	cfg.Debug = *debug
+	cfg.Readline = *readline
+
+	if *prefix == "" || strings.ContainsFunc(*prefix, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r) || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) {
+		usageError("invalid -prefix %q, must be punctuation such as / or !", *prefix)
+	}
+	cfg.CommandPrefix = *prefix
 
-		if nameTaken {
-			conn.Write([]byte("Name already taken. Choose another name:\n[ENTER YOUR NAME]: "))
-			continue
-		}
+	if *prompt == "" || strings.ContainsFunc(*prompt, unicode.IsControl) {
+		usageError("invalid -prompt %q, must be non-empty printable text", *prompt)
+	}
+	cfg.NamePrompt = *prompt
 
-		return name
+	port := cfg.Port
+	if configPort != "" {
+		port = configPort
+	}
+	if flag.NArg() == 1 {
+		port = flag.Arg(0)
+	}
+	// Port 0 asks the OS for a free port; Start prints the one chosen
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		usageError("invalid port %q, must be a number from 0 to 65535", port)
 	}
+	cfg.Port = port
+	return cfg
 }
 
-// -----------------------------
-// BROADCAST
-// -----------------------------
-func broadcast(msg string, sender net.Conn) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	for c := range clients {
-		switch {
-		case c == sender:
-			// Current user sees full message with timestamp and username in green
-			c.Write([]byte(ColorGreen + msg + ColorReset + "\n"))
-		default:
-			// Others see full message in blue
-			c.Write([]byte(ColorBlue + msg + ColorReset + "\n"))
+// listenHost checks a -host value and returns it in the form
+// net.JoinHostPort expects. Bracketed IPv6 literals such as [::1] are
+// accepted; a host name must resolve.
+func listenHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return "", err
 		}
 	}
+	return host, nil
 }
 
-// -----------------------------
-// ANNOUNCE SYSTEM
-// -----------------------------
-func announce(msg string, excludeConn net.Conn) {
-	mutex.Lock()
-	messages = append(messages, msg)
-	for c := range clients {
-		if c != excludeConn {
-			c.Write([]byte(ColorYellow + msg + ColorReset + "\n"))
-		}
-	}
-	mutex.Unlock()
+// usageError reports a bad command line and exits with status 1.
+func usageError(format string, args ...any) {
+	fmt.Printf("Error: "+format+"\n", args...)
+	fmt.Println(usage)
+	os.Exit(1)
 }
 
-// -----------------------------
-// FORMAT MESSAGE
-// -----------------------------
-func formatMessage(name, text string) string {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	return fmt.Sprintf("[%s][%s]:%s", timestamp, name, text)
+// fatal reports an error that prevents the server from running and exits
+// with status 1.
+func fatal(format string, args ...any) {
+	fmt.Printf("Error: "+format+"\n", args...)
+	os.Exit(1)
 }
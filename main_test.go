@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/SIM0N0URI/NETCAT-v1.0/chat"
+)
+
+// testConfig is the default configuration on a free loopback port, with
+// the server's files in a temporary directory.
+func testConfig(t testing.TB) chat.Config {
+	dir := t.TempDir()
+	cfg := chat.DefaultConfig()
+	cfg.Host, cfg.Port = "127.0.0.1", "0"
+	cfg.LogoPath = filepath.Join(dir, "logo.txt")
+	cfg.HistoryFile = filepath.Join(dir, "chat.log")
+	cfg.BanFile = filepath.Join(dir, "bans.txt")
+	cfg.LogFile = filepath.Join(dir, "events.log")
+	return cfg
+}
+
+func TestListenHost(t *testing.T) {
+	for _, tc := range []struct{ in, want, addr string }{
+		{"", "", ":8989"},
+		{"127.0.0.1", "127.0.0.1", "127.0.0.1:8989"},
+		{"::1", "::1", "[::1]:8989"},
+		{"[::1]", "::1", "[::1]:8989"},
+		{"[fe80::1%eth0]", "fe80::1%eth0", "[fe80::1%eth0]:8989"},
+		{"localhost", "localhost", "localhost:8989"},
+	} {
+		got, err := listenHost(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("listenHost(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+			continue
+		}
+		if addr := net.JoinHostPort(got, "8989"); addr != tc.addr {
+			t.Errorf("listen address for %q = %q, want %q", tc.in, addr, tc.addr)
+		}
+	}
+	if _, err := listenHost("no-such-host.invalid"); err == nil {
+		t.Error("unresolvable host accepted")
+	}
+}
+
+func TestListenOnIPv6Host(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	} else {
+		ln.Close()
+	}
+	cfg := testConfig(t)
+	host, err := listenHost("[::1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Host = host
+	srv := chat.NewServer(cfg)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	addr := srv.Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.IPv6loopback) {
+		t.Fatalf("listening on %s, want ::1", addr)
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}